@@ -0,0 +1,76 @@
+package wazemmes
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// The actions a guest returns in its output to drive the middleware chain.
+// Without action, the guest body is written and the next handler is called.
+const (
+	// ActionContinue calls the next handler without writing the guest body.
+	ActionContinue = "continue"
+	// ActionRespond writes the guest response and stops the chain.
+	ActionRespond = "respond"
+	// ActionRedirect redirects the client to the Location header returned by
+	// the guest, and stops the chain.
+	ActionRedirect = "redirect"
+)
+
+var ErrUnknownAction = errors.New("unknown guest action")
+
+// stop applies the guest response headers, and writes the guest response
+// when the guest failed or answered itself. It tells whether the chain ends
+// here, the invalid headers are logged and dropped.
+func (b baseHandler) stop(rw http.ResponseWriter, logger *zap.Logger) (bool, error) {
+	if b.Error != "" {
+		rw.WriteHeader(http.StatusInternalServerError)
+		_, _ = rw.Write([]byte(b.Error))
+
+		return true, errors.New(b.Error)
+	}
+
+	if err := b.Response.validate(logger); err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+
+		return true, err
+	}
+
+	applyHeaders(rw.Header(), b.Response.Headers)
+
+	switch b.Action {
+	case "", ActionContinue:
+		return false, nil
+	case ActionRespond:
+		status := b.Response.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		b.Response.write(rw, status)
+
+		return true, nil
+	case ActionRedirect:
+		status := b.Response.Status
+		if status == 0 {
+			status = http.StatusFound
+		}
+
+		if rw.Header().Get("Location") == "" || status < 300 || status > 399 {
+			rw.WriteHeader(http.StatusInternalServerError)
+
+			return true, fmt.Errorf("the guest redirect expects a Location header and a 3xx status, got %d", status)
+		}
+
+		b.Response.write(rw, status)
+
+		return true, nil
+	default:
+		rw.WriteHeader(http.StatusInternalServerError)
+
+		return true, fmt.Errorf("%w: %s", ErrUnknownAction, b.Action)
+	}
+}
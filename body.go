@@ -0,0 +1,129 @@
+package wazemmes
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"unicode/utf8"
+)
+
+// BodyEncodingBase64 flags the bodies carried as base64 in the JSON protocol,
+// the bodies without flag are UTF-8 text.
+const BodyEncodingBase64 = "base64"
+
+// encodeBody keeps the valid UTF-8 bodies as is for the existing guests, the
+// binary ones are encoded in base64.
+func encodeBody(body string) (string, string) {
+	if utf8.ValidString(body) {
+		return body, ""
+	}
+
+	return base64.StdEncoding.EncodeToString([]byte(body)), BodyEncodingBase64
+}
+
+func decodeBody(body, encoding string) (string, error) {
+	switch encoding {
+	case "":
+		return body, nil
+	case BodyEncodingBase64:
+		decoded, err := base64.StdEncoding.DecodeString(body)
+		if err != nil {
+			return "", fmt.Errorf("invalid base64 guest body: %w", err)
+		}
+
+		return string(decoded), nil
+	default:
+		return "", fmt.Errorf("unknown guest body encoding: %s", encoding)
+	}
+}
+
+// The JSON views of the request and response, without their methods. Their
+// body is carried by an encodedBody.
+type (
+	requestJSON  request
+	responseJSON response
+)
+
+type encodedBody struct {
+	Body         *string `json:"body,omitempty"`
+	BodyEncoding string  `json:"bodyEncoding,omitempty"`
+}
+
+func newEncodedBody(body string) encodedBody {
+	encoded, encoding := encodeBody(body)
+
+	return encodedBody{Body: &encoded, BodyEncoding: encoding}
+}
+
+// decode leaves the body untouched when the guest omitted it.
+func (e encodedBody) decode(body *string) error {
+	if e.Body == nil {
+		return nil
+	}
+
+	decoded, err := decodeBody(*e.Body, e.BodyEncoding)
+	if err != nil {
+		return err
+	}
+
+	*body = decoded
+
+	return nil
+}
+
+// MarshalJSON omits the streamed body, so the guests echoing their input
+// keep it.
+func (r request) MarshalJSON() ([]byte, error) {
+	body := newEncodedBody(r.Body)
+	if r.Stream {
+		body = encodedBody{}
+	}
+
+	return json.Marshal(struct {
+		requestJSON
+		encodedBody
+		URL any `json:"url"`
+	}{requestJSON(r), body, marshalURL(r.URL, r.version)})
+}
+
+func (r *request) UnmarshalJSON(data []byte) error {
+	aux := struct {
+		*requestJSON
+		encodedBody
+		URL json.RawMessage `json:"url"`
+	}{requestJSON: (*requestJSON)(r)}
+
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+
+	u, err := unmarshalURL(aux.URL, r.URL)
+	if err != nil {
+		return err
+	}
+
+	r.URL = u
+	r.bodySet = aux.encodedBody.Body != nil
+
+	return aux.decode(&r.Body)
+}
+
+func (r response) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		responseJSON
+		encodedBody
+	}{responseJSON(r), newEncodedBody(r.Body)})
+}
+
+func (r *response) UnmarshalJSON(data []byte) error {
+	aux := struct {
+		*responseJSON
+		encodedBody
+	}{responseJSON: (*responseJSON)(r)}
+
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+
+	return aux.decode(&r.Body)
+}
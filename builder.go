@@ -0,0 +1,177 @@
+package wazemmes
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// DefaultBuilder is used when no builder is given.
+const DefaultBuilder = AutoBuilder
+
+var ErrUnknownBuilder = errors.New("unknown builder")
+
+// BuilderOptions are the values passed to a BuilderFactory to build a handler.
+type BuilderOptions struct {
+	Source        ModuleSource
+	Configuration any
+	Pool          map[string]interface{}
+	Logger        *zap.Logger
+	// Snapshot enables the snapshot mode of the js builder.
+	Snapshot *SnapshotConfiguration
+	// HandleResponse calls the js guests a second time with the downstream
+	// response.
+	HandleResponse bool
+	// Encoding selects the encoding of the messages sent to the js guests,
+	// EncodingJSON by default.
+	Encoding string
+	// StreamBody streams the request body to the js, php and cgi guests as it
+	// arrives instead of buffering it.
+	StreamBody bool
+	// MaxBodySize rejects the larger request bodies with a 413 status, the
+	// bodies are unbounded when zero.
+	MaxBodySize int64
+	// DocumentRoot routes the requests of the php builder to the scripts of
+	// this directory, the source script runs for every request without it.
+	// A directory runs its first existing IndexFiles, DefaultIndexFiles by
+	// default, and the paths matching no file run the FrontController script
+	// when set.
+	DocumentRoot    string
+	IndexFiles      []string
+	FrontController string
+	// Interpreter replaces the php-cgi embedded in the php builder, e.g. for
+	// another PHP version or more extensions. NewSharedFileSource shares it
+	// between the items.
+	Interpreter ModuleSource
+	// Mounts expose host directories to the php and cgi guests, the php ones
+	// see the parent of the working directory without them. PHPIni is read at
+	// build time and the PHPIniDirectives are appended to it, each php
+	// instance has a writable scratch directory at /tmp.
+	Mounts           []Mount
+	PHPIni           string
+	PHPIniDirectives map[string]string
+	// Routes map the request paths to their modules in the cgi builder, the
+	// Source runs for the other paths when set.
+	Routes []Route
+	// StreamResponse writes what the js, php and cgi guests output after their
+	// header block to the client as it comes, with a flush for each write.
+	StreamResponse bool
+	// CacheDir persists the compiled modules on disk, they are kept in memory
+	// when empty.
+	CacheDir string
+	// Timeout aborts the guest when it runs for longer, the client receives
+	// the TimeoutStatus, 504 by default.
+	Timeout       time.Duration
+	TimeoutStatus int
+	// MemoryLimit bounds the memory of each instance in bytes, it is rounded
+	// down to WASM pages.
+	MemoryLimit uint64
+	// MemoryBudget is shared by the handlers reserving their memory in it,
+	// the budget of SetMemoryBudget is used when nil.
+	MemoryBudget *MemoryBudget
+	// DisableReload doesn't watch the module files, they are polled every 2
+	// seconds for the hot reload otherwise.
+	DisableReload bool
+}
+
+// sources returns the module sources the builders read, they are watched for
+// the hot reload except the php scripts.
+func (o BuilderOptions) sources() []ModuleSource {
+	sources := make([]ModuleSource, 0, len(o.Routes)+2)
+
+	for _, source := range []ModuleSource{o.Source, o.Interpreter} {
+		if source != nil {
+			sources = append(sources, source)
+		}
+	}
+
+	for _, route := range o.Routes {
+		if route.Source != nil {
+			sources = append(sources, route.Source)
+		}
+	}
+
+	return sources
+}
+
+// BuilderFactory builds a WasmHandler for a given runtime.
+type BuilderFactory func(options BuilderOptions) (*WasmHandler, error)
+
+var (
+	buildersMu sync.RWMutex
+	builders   = map[string]BuilderFactory{}
+)
+
+func init() {
+	RegisterBuilder("go", newWasmHandlerGo, "golang", "tinygo", "http-wasm")
+	RegisterBuilder("js", newWasmHandlerJS, "javascript", "asc", "assemblyscript")
+	RegisterBuilder("php", newWasmHandlerPHP)
+	RegisterBuilder("cgi", newWasmHandlerCGI, "wagi")
+}
+
+// RegisterBuilder makes a builder available by its name and its aliases. It
+// panics if the name or one of the aliases is empty or already registered.
+func RegisterBuilder(name string, factory BuilderFactory, aliases ...string) {
+	buildersMu.Lock()
+	defer buildersMu.Unlock()
+
+	if factory == nil {
+		panic("wazemmes: RegisterBuilder factory is nil for " + name)
+	}
+
+	for _, key := range append([]string{name}, aliases...) {
+		key = strings.ToLower(key)
+		if key == "" {
+			panic("wazemmes: RegisterBuilder called with an empty name")
+		}
+
+		if _, exists := builders[key]; exists {
+			panic("wazemmes: RegisterBuilder called twice for " + key)
+		}
+
+		builders[key] = factory
+	}
+}
+
+// IsBuilderRegistered reports whether the name or alias is a known builder.
+func IsBuilderRegistered(name string) bool {
+	_, err := lookupBuilder(name)
+
+	return err == nil
+}
+
+// Builders returns the sorted registered builder names and aliases.
+func Builders() []string {
+	buildersMu.RLock()
+	defer buildersMu.RUnlock()
+
+	names := make([]string, 0, len(builders))
+	for name := range builders {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+func lookupBuilder(name string) (BuilderFactory, error) {
+	if name == "" {
+		name = DefaultBuilder
+	}
+
+	buildersMu.RLock()
+	factory, ok := builders[strings.ToLower(name)]
+	buildersMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("%w %q, expected one of %s", ErrUnknownBuilder, name, strings.Join(Builders(), ", "))
+	}
+
+	return factory, nil
+}
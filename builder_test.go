@@ -0,0 +1,85 @@
+package wazemmes
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestRegisterBuilder(t *testing.T) {
+	var built string
+
+	RegisterBuilder("registry-test", func(o BuilderOptions) (*WasmHandler, error) {
+		built = o.Source.Name()
+
+		return nil, nil
+	}, "Registry-Alias")
+
+	for _, tc := range []struct {
+		name string
+		err  error
+	}{
+		{name: "registry-test"},
+		{name: "REGISTRY-TEST"},
+		{name: "registry-alias"},
+		{name: "Registry-Alias"},
+		{name: "registry-unknown", err: ErrUnknownBuilder},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			built = ""
+
+			factory, err := lookupBuilder(tc.name)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("got the error %v, expected %v", err, tc.err)
+			}
+
+			if factory != nil {
+				_, _ = factory(BuilderOptions{Source: NewBytesSource(tc.name, nil)})
+			}
+
+			if IsBuilderRegistered(tc.name) != (tc.err == nil) {
+				t.Errorf("IsBuilderRegistered returned %t", tc.err != nil)
+			}
+
+			if tc.err == nil && built != tc.name {
+				t.Errorf("the factory built %q", built)
+			}
+		})
+	}
+
+	names := Builders()
+	if !slices.IsSorted(names) || !slices.Contains(names, "registry-test") || !slices.Contains(names, "registry-alias") {
+		t.Errorf("got the builders %v", names)
+	}
+
+	if !IsBuilderRegistered("") {
+		t.Errorf("the default builder %s is not registered", DefaultBuilder)
+	}
+}
+
+func TestRegisterBuilderPanics(t *testing.T) {
+	factory := func(BuilderOptions) (*WasmHandler, error) { return nil, nil }
+
+	for _, tc := range []struct {
+		name    string
+		builder string
+		factory BuilderFactory
+		aliases []string
+	}{
+		{name: "nil factory", builder: "registry-nil"},
+		{name: "empty name", factory: factory},
+		{name: "empty alias", builder: "registry-empty-alias", factory: factory, aliases: []string{""}},
+		{name: "registered name", builder: "js", factory: factory},
+		{name: "registered alias", builder: "registry-twice", factory: factory, aliases: []string{"WAGI"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Error("RegisterBuilder didn't panic")
+				}
+			}()
+
+			RegisterBuilder(tc.builder, tc.factory, tc.aliases...)
+		})
+	}
+}
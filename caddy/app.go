@@ -0,0 +1,90 @@
+package caddy
+
+import (
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/darkweak/wazemmes"
+	"github.com/dustin/go-humanize"
+)
+
+// WasmApp holds the host-wide settings of the wasm handlers, its memory
+// budget is shared by every handler of the configuration.
+type WasmApp struct {
+	MemoryBudget uint64 `json:"memory_budget,omitempty"`
+	MemoryQueue  bool   `json:"memory_queue,omitempty"`
+	budget       *wazemmes.MemoryBudget
+}
+
+func init() {
+	caddy.RegisterModule(WasmApp{})
+	httpcaddyfile.RegisterGlobalOption(moduleName, parseCaddyfileGlobalOption)
+}
+
+// CaddyModule returns the Caddy module information.
+func (WasmApp) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  moduleName,
+		New: func() caddy.Module { return new(WasmApp) },
+	}
+}
+
+// Provision creates the budget of the configuration, the handlers are not
+// bounded without it.
+func (a *WasmApp) Provision(caddy.Context) error {
+	if a.MemoryBudget > 0 {
+		a.budget = wazemmes.NewMemoryBudget(a.MemoryBudget, a.MemoryQueue)
+	}
+
+	return nil
+}
+
+// Start implements caddy.App.
+func (*WasmApp) Start() error {
+	return nil
+}
+
+// Stop implements caddy.App.
+func (*WasmApp) Stop() error {
+	return nil
+}
+
+// parseCaddyfileGlobalOption parses the wasm global option into the wasm
+// app.
+func parseCaddyfileGlobalOption(d *caddyfile.Dispenser, _ any) (any, error) {
+	app := new(WasmApp)
+
+	for d.Next() {
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			switch directive := d.Val(); directive {
+			case "memory_budget":
+				args := d.RemainingArgs()
+				if len(args) == 0 || len(args) > 2 {
+					return nil, d.Errf("the memory_budget directive expects a size and an optional queue or reject mode")
+				}
+
+				budget, err := humanize.ParseBytes(args[0])
+				if err != nil {
+					return nil, d.Errf("invalid memory_budget value: %v", err)
+				}
+
+				app.MemoryBudget = budget
+				if len(args) == 2 {
+					switch args[1] {
+					case "queue":
+						app.MemoryQueue = true
+					case "reject":
+						app.MemoryQueue = false
+					default:
+						return nil, d.Errf("unsupported memory_budget mode: %s", args[1])
+					}
+				}
+			default:
+				return nil, d.Errf("unsupported global directive: %s", directive)
+			}
+		}
+	}
+
+	return httpcaddyfile.App{Name: moduleName, Value: caddyconfig.JSON(app, nil)}, nil
+}
@@ -1,6 +1,8 @@
 package caddy
 
 import (
+	"context"
+	"errors"
 	"net/http"
 	"strconv"
 	"strings"
@@ -12,24 +14,52 @@ import (
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"github.com/darkweak/wazemmes"
+	"github.com/dustin/go-humanize"
 	"go.uber.org/zap"
 )
 
 type wasmModule struct {
-	Builder       string      `json:"builder"`
-	Configuration interface{} `json:"configuration"`
-	Filepath      string      `json:"filepath"`
+	Builder          string                          `json:"builder"`
+	Configuration    interface{}                     `json:"configuration"`
+	Filepath         string                          `json:"filepath"`
+	Snapshot         *wazemmes.SnapshotConfiguration `json:"snapshot,omitempty"`
+	Timeout          caddy.Duration                  `json:"timeout,omitempty"`
+	TimeoutStatus    int                             `json:"timeout_status,omitempty"`
+	MemoryLimit      uint64                          `json:"memory_limit,omitempty"`
+	ResponsePhase    bool                            `json:"response_phase,omitempty"`
+	Encoding         string                          `json:"encoding,omitempty"`
+	StreamBody       bool                            `json:"stream_body,omitempty"`
+	MaxBodySize      uint64                          `json:"max_body_size,omitempty"`
+	StreamResponse   bool                            `json:"stream_response,omitempty"`
+	DocumentRoot     string                          `json:"document_root,omitempty"`
+	IndexFiles       []string                        `json:"index_files,omitempty"`
+	FrontController  string                          `json:"front_controller,omitempty"`
+	Mounts           []wazemmes.Mount                `json:"mounts,omitempty"`
+	PHPIni           string                          `json:"php_ini,omitempty"`
+	PHPIniDirectives map[string]string               `json:"php_ini_directives,omitempty"`
+	Interpreter      string                          `json:"interpreter,omitempty"`
+	Routes           []wasmRoute                     `json:"routes,omitempty"`
+}
+
+// wasmRoute maps a path to the module of the cgi builder.
+type wasmRoute struct {
+	Path     string `json:"path"`
+	Filepath string `json:"filepath"`
 }
 
 type CaddyWasm struct {
 	Items            []wasmModule           `json:"items"`
 	Pool             map[string]interface{} `json:"pool"`
+	CacheDir         string                 `json:"cache_dir,omitempty"`
+	DisableReload    bool                   `json:"disable_reload,omitempty"`
 	middlewaresChain []*wazemmes.WasmHandler
 	logger           *zap.Logger
-	cachedChain      wazemmes.Handler
 }
 
-const moduleName = "wasm"
+const (
+	moduleName     = "wasm"
+	cleanupTimeout = 10 * time.Second
+)
 
 func parseCaddyfileRecursively(h *caddyfile.Dispenser) interface{} {
 	input := make(map[string]interface{})
@@ -80,7 +110,17 @@ func parsePool(h httpcaddyfile.Helper) (map[string]interface{}, error) {
 				pool[directive], _ = strconv.ParseBool(args[0])
 			}
 		case "MaxTotal", "MaxIdle", "MinIdle", "NumTestsPerEvictionRun":
-			pool[directive] = true
+			args := h.RemainingArgs()
+			if len(args) == 0 {
+				return nil, h.Errf("the pool directive %s expects a value", directive)
+			}
+
+			value, err := strconv.Atoi(args[0])
+			if err != nil {
+				return nil, h.Errf("invalid %s value: %v", directive, err)
+			}
+
+			pool[directive] = value
 		case "MinEvictableIdleTime", "SoftMinEvictableIdleTime", "TimeBetweenEvictionRuns":
 			args := h.RemainingArgs()
 			pool[directive], _ = time.ParseDuration(args[0])
@@ -109,16 +149,207 @@ func parseCaddyfileHandlerDirective(h httpcaddyfile.Helper) (caddyhttp.Middlewar
 					switch directive {
 					case "builder":
 						module.Builder = h.RemainingArgs()[0]
+						if !wazemmes.IsBuilderRegistered(module.Builder) {
+							return nil, h.Errf("unsupported builder %s, expected one of %s", module.Builder, strings.Join(wazemmes.Builders(), ", "))
+						}
 					case "filepath":
 						module.Filepath = h.RemainingArgs()[0]
+					case "document_root":
+						args := h.RemainingArgs()
+						if len(args) != 1 {
+							return nil, h.Errf("the document_root directive expects one directory")
+						}
+
+						module.DocumentRoot = args[0]
+					case "index":
+						module.IndexFiles = h.RemainingArgs()
+						if len(module.IndexFiles) == 0 {
+							return nil, h.ArgErr()
+						}
+					case "front_controller":
+						args := h.RemainingArgs()
+						switch len(args) {
+						case 0:
+							module.FrontController = "index.php"
+						case 1:
+							module.FrontController = args[0]
+						default:
+							return nil, h.Errf("the front_controller directive expects at most one script")
+						}
+					case "interpreter":
+						args := h.RemainingArgs()
+						if len(args) != 1 {
+							return nil, h.Errf("the interpreter directive expects one WASM module")
+						}
+
+						module.Interpreter = args[0]
+					case "route":
+						args := h.RemainingArgs()
+						if len(args) != 2 {
+							return nil, h.Errf("the route directive expects a path and a WASM module")
+						}
+
+						module.Routes = append(module.Routes, wasmRoute{Path: args[0], Filepath: args[1]})
+					case "mount":
+						args := h.RemainingArgs()
+						if len(args) == 0 || len(args) > 3 {
+							return nil, h.Errf("the mount directive expects a host path, an optional guest path and ro or rw")
+						}
+
+						mount, err := wazemmes.ParseMount(strings.Join(args, ":"))
+						if err != nil {
+							return nil, h.Errf("invalid mount: %v", err)
+						}
+
+						module.Mounts = append(module.Mounts, mount)
+					case "php_ini":
+						args := h.RemainingArgs()
+						switch len(args) {
+						case 0:
+						case 1:
+							module.PHPIni = args[0]
+						default:
+							return nil, h.Errf("the php_ini directive expects at most one file")
+						}
+
+						for nesting := h.Nesting(); h.NextBlock(nesting); {
+							key := h.Val()
+							values := h.RemainingArgs()
+							if len(values) != 1 {
+								return nil, h.Errf("the php_ini directive %s expects one value", key)
+							}
+
+							if module.PHPIniDirectives == nil {
+								module.PHPIniDirectives = map[string]string{}
+							}
+
+							module.PHPIniDirectives[key] = values[0]
+						}
 					case "configuration":
 						module.Configuration = parseCaddyfileRecursively(h.Dispenser)
+					case "timeout":
+						args := h.RemainingArgs()
+						if len(args) != 1 {
+							return nil, h.Errf("the timeout directive expects one duration")
+						}
+
+						timeout, err := caddy.ParseDuration(args[0])
+						if err != nil {
+							return nil, h.Errf("invalid timeout value: %v", err)
+						}
+
+						module.Timeout = caddy.Duration(timeout)
+					case "timeout_status":
+						args := h.RemainingArgs()
+						if len(args) != 1 {
+							return nil, h.Errf("the timeout_status directive expects one status code")
+						}
+
+						status, err := strconv.Atoi(args[0])
+						if err != nil {
+							return nil, h.Errf("invalid timeout_status value: %v", err)
+						}
+
+						module.TimeoutStatus = status
+					case "memory_limit":
+						args := h.RemainingArgs()
+						if len(args) != 1 {
+							return nil, h.Errf("the memory_limit directive expects one size")
+						}
+
+						limit, err := humanize.ParseBytes(args[0])
+						if err != nil {
+							return nil, h.Errf("invalid memory_limit value: %v", err)
+						}
+
+						module.MemoryLimit = limit
+					case "response_phase":
+						args := h.RemainingArgs()
+						switch len(args) {
+						case 0:
+							module.ResponsePhase = true
+						case 1:
+							enabled, err := strconv.ParseBool(args[0])
+							if err != nil {
+								return nil, h.Errf("invalid response_phase value: %v", err)
+							}
+
+							module.ResponsePhase = enabled
+						default:
+							return nil, h.Errf("the response_phase directive expects at most one value")
+						}
+					case "stream_body":
+						if h.NextArg() {
+							return nil, h.ArgErr()
+						}
+
+						module.StreamBody = true
+					case "stream_response":
+						if h.NextArg() {
+							return nil, h.ArgErr()
+						}
+
+						module.StreamResponse = true
+					case "max_body_size":
+						args := h.RemainingArgs()
+						if len(args) != 1 {
+							return nil, h.Errf("the max_body_size directive expects one size")
+						}
+
+						size, err := humanize.ParseBytes(args[0])
+						if err != nil {
+							return nil, h.Errf("invalid max_body_size value: %v", err)
+						}
+
+						module.MaxBodySize = size
+					case "encoding":
+						args := h.RemainingArgs()
+						if len(args) != 1 {
+							return nil, h.Errf("the encoding directive expects one encoding")
+						}
+
+						if args[0] != wazemmes.EncodingJSON && args[0] != wazemmes.EncodingBinary {
+							return nil, h.Errf("unsupported encoding: %s", args[0])
+						}
+
+						module.Encoding = args[0]
+					case "snapshot":
+						module.Snapshot = &wazemmes.SnapshotConfiguration{}
+						for nesting := h.Nesting(); h.NextBlock(nesting); {
+							snapshotDirective := h.Val()
+							args := h.RemainingArgs()
+							if len(args) != 1 {
+								return nil, h.Errf("the snapshot directive %s expects one value", snapshotDirective)
+							}
+
+							switch snapshotDirective {
+							case "init":
+								module.Snapshot.Init = args[0]
+							case "entry":
+								module.Snapshot.Entry = args[0]
+							default:
+								return nil, h.Errf("unsupported snapshot directive: %s", snapshotDirective)
+							}
+						}
 					default:
 						return nil, h.Errf("unsupported item directive: %s", directive)
 					}
 				}
 
 				wasmConfig.Items = append(wasmConfig.Items, module)
+			case "cache_dir":
+				args := h.RemainingArgs()
+				if len(args) != 1 {
+					return nil, h.Errf("the cache_dir directive expects one directory")
+				}
+
+				wasmConfig.CacheDir = args[0]
+			case "disable_reload":
+				if h.NextArg() {
+					return nil, h.ArgErr()
+				}
+
+				wasmConfig.DisableReload = true
 			case "pool":
 				var err error
 
@@ -152,10 +383,75 @@ func (CaddyWasm) CaddyModule() caddy.ModuleInfo {
 // Provision to do the provisioning part.
 func (c *CaddyWasm) Provision(ctx caddy.Context) error {
 	c.logger = ctx.Logger(c)
+
+	// The budget of the wasm app is shared by every handler of this
+	// configuration, the handlers of the previous one keep their reservations
+	// in their own budget while it is replaced.
+	var budget *wazemmes.MemoryBudget
+
+	app, err := ctx.AppIfConfigured(moduleName)
+	switch {
+	case err == nil:
+		budget = app.(*WasmApp).budget
+	case !errors.Is(err, caddy.ErrNotConfigured):
+		return err
+	}
+
+	return c.provision(budget)
+}
+
+// provision builds the handlers of the items reserving their memory in the
+// budget.
+func (c *CaddyWasm) provision(budget *wazemmes.MemoryBudget) error {
 	wasmHandlers := make([]*wazemmes.WasmHandler, 0)
 	for _, item := range c.Items {
-		h, err := wazemmes.NewWasmHandler(item.Filepath, item.Builder, item.Configuration, c.Pool, c.logger)
+		var interpreter wazemmes.ModuleSource
+		if item.Interpreter != "" {
+			interpreter = wazemmes.NewSharedFileSource(item.Interpreter)
+		}
+
+		// The items of the cgi builder may only have routes, and the ones of
+		// the php builder a document root.
+		source := wazemmes.NewFileSource(item.Filepath)
+		if item.Filepath == "" && (len(item.Routes) > 0 || item.DocumentRoot != "") {
+			source = nil
+		}
+
+		routes := make([]wazemmes.Route, 0, len(item.Routes))
+		for _, route := range item.Routes {
+			routes = append(routes, wazemmes.Route{Path: route.Path, Source: wazemmes.NewFileSource(route.Filepath)})
+		}
+
+		h, err := wazemmes.NewWasmHandlerWithOptions(item.Builder, wazemmes.BuilderOptions{
+			Source:           source,
+			Configuration:    item.Configuration,
+			Pool:             c.Pool,
+			Logger:           c.logger,
+			Snapshot:         item.Snapshot,
+			CacheDir:         c.CacheDir,
+			DisableReload:    c.DisableReload,
+			Timeout:          time.Duration(item.Timeout),
+			TimeoutStatus:    item.TimeoutStatus,
+			MemoryLimit:      item.MemoryLimit,
+			MemoryBudget:     budget,
+			HandleResponse:   item.ResponsePhase,
+			Encoding:         item.Encoding,
+			StreamBody:       item.StreamBody,
+			MaxBodySize:      int64(item.MaxBodySize),
+			StreamResponse:   item.StreamResponse,
+			DocumentRoot:     item.DocumentRoot,
+			IndexFiles:       item.IndexFiles,
+			FrontController:  item.FrontController,
+			Mounts:           item.Mounts,
+			PHPIni:           item.PHPIni,
+			PHPIniDirectives: item.PHPIniDirectives,
+			Interpreter:      interpreter,
+			Routes:           routes,
+		})
 		if err != nil {
+			c.middlewaresChain = wasmHandlers
+			_ = c.Cleanup()
+
 			return err
 		}
 
@@ -163,29 +459,50 @@ func (c *CaddyWasm) Provision(ctx caddy.Context) error {
 	}
 
 	c.middlewaresChain = wasmHandlers
-	c.cachedChain = wazemmes.BuildMiddlewareChain(c.logger, c.middlewaresChain)
 
 	return nil
 }
 
+// Cleanup implements caddy.CleanerUpper, it releases the WASM handlers when
+// the configuration is unloaded.
+func (c *CaddyWasm) Cleanup() error {
+	ctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+	defer cancel()
+
+	errs := make([]error, 0, len(c.middlewaresChain))
+	for _, h := range c.middlewaresChain {
+		errs = append(errs, h.Close(ctx))
+	}
+
+	return errors.Join(errs...)
+}
+
 // ServeHTTP implements caddyhttp.MiddlewareHandler.
 func (c CaddyWasm) ServeHTTP(rw http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
 	writer := wazemmes.BuildWriter(rw, r)
 
-	err := c.cachedChain.ServeHTTP(writer, r)
-	if err != nil {
-		c.logger.Sugar().Errorf("buildMiddlewareChain: %v", err)
+	// The chain ends with the caddy next handler, so the guests handling the
+	// response receive the downstream one.
+	var nextErr error
+	chain := wazemmes.BuildMiddlewareChainWithNext(c.logger, c.middlewaresChain, wazemmes.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) error {
+		nextErr = next.ServeHTTP(rw, req)
 
-		writer.Flush()
+		return nextErr
+	}))
 
-		return nil
+	err := chain.ServeHTTP(writer, r)
+	if nextErr != nil {
+		c.logger.Sugar().Errorf("next.ServeHTTP: %v", nextErr)
+
+		return nextErr
 	}
 
-	err = next.ServeHTTP(writer, r)
 	if err != nil {
-		c.logger.Sugar().Errorf("next.ServeHTTP: %v", err)
+		c.logger.Sugar().Errorf("buildMiddlewareChain: %v", err)
 
-		return err
+		writer.Flush()
+
+		return nil
 	}
 
 	writer.Flush()
@@ -0,0 +1,130 @@
+package caddy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	_ "github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/darkweak/wazemmes"
+	"go.uber.org/zap"
+)
+
+// newApp provisions the wasm app with the budget.
+func newApp(t *testing.T, budget uint64) *WasmApp {
+	t.Helper()
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+
+	app := &WasmApp{MemoryBudget: budget}
+	if err := app.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	return app
+}
+
+// provision provisions a wasm block of one cgi item reserving 6MiB per
+// instance in the budget of the app.
+func provision(t *testing.T, app *WasmApp) (*CaddyWasm, error) {
+	t.Helper()
+
+	module := filepath.Join(t.TempDir(), "empty.wasm")
+	if err := os.WriteFile(module, []byte("\x00asm\x01\x00\x00\x00"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &CaddyWasm{
+		Items:  []wasmModule{{Filepath: module, Builder: "cgi", MemoryLimit: 6 << 20}},
+		Pool:   map[string]interface{}{"MaxTotal": 1},
+		logger: zap.NewNop(),
+	}
+
+	t.Cleanup(func() {
+		_ = c.Cleanup()
+	})
+
+	return c, c.provision(app.budget)
+}
+
+func TestMemoryBudgetIsHostWide(t *testing.T) {
+	app := newApp(t, 10<<20)
+
+	if _, err := provision(t, app); err != nil {
+		t.Fatalf("got the error %v", err)
+	}
+
+	// The second wasm block reserves in the same budget.
+	if _, err := provision(t, app); !errors.Is(err, wazemmes.ErrMemoryBudgetExhausted) {
+		t.Errorf("got the error %v, expected %v", err, wazemmes.ErrMemoryBudgetExhausted)
+	}
+
+	unbounded := newApp(t, 0)
+	for range 2 {
+		if _, err := provision(t, unbounded); err != nil {
+			t.Fatalf("got the error %v without budget", err)
+		}
+	}
+}
+
+func TestReloadUnderMemoryBudget(t *testing.T) {
+	// Each configuration reserves more than half of its budget, the new one
+	// is provisioned while the old one still holds its instances.
+	previous, err := provision(t, newApp(t, 10<<20))
+	if err != nil {
+		t.Fatalf("got the error %v", err)
+	}
+
+	if _, err = provision(t, newApp(t, 10<<20)); err != nil {
+		t.Fatalf("got the error %v while reloading", err)
+	}
+
+	if err = previous.Cleanup(); err != nil {
+		t.Errorf("got the error %v while cleaning up", err)
+	}
+}
+
+func TestCaddyfileGlobalOption(t *testing.T) {
+	config, _, err := caddyconfig.GetAdapter("caddyfile").Adapt([]byte(`{
+	wasm {
+		memory_budget 64MiB queue
+	}
+}
+
+:8080 {
+	wasm {
+		disable_reload
+		item {
+			filepath plugin.wasm
+		}
+	}
+}`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var parsed struct {
+		Apps struct {
+			Wasm WasmApp `json:"wasm"`
+		} `json:"apps"`
+	}
+
+	if err = json.Unmarshal(config, &parsed); err != nil {
+		t.Fatal(err)
+	}
+
+	if parsed.Apps.Wasm.MemoryBudget != 64<<20 || !parsed.Apps.Wasm.MemoryQueue {
+		t.Errorf("got the wasm app %+v from %s", parsed.Apps.Wasm, config)
+	}
+
+	if !bytes.Contains(config, []byte(`"disable_reload":true`)) {
+		t.Errorf("the disable_reload directive is missing from %s", config)
+	}
+}
@@ -0,0 +1,482 @@
+package wazemmes
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+var ErrInvalidCGIResponse = errors.New("invalid CGI response")
+
+// CGIActionHeader is the CGI response header of the php and cgi guests
+// handing the request to the next handler with the ActionContinue value.
+const CGIActionHeader = "X-Wazemmes-Action"
+
+const (
+	// maxCGIHeader bounds the header block of a CGI response.
+	maxCGIHeader = 64 << 10
+	// maxCGIRedirects bounds the local redirects of a request.
+	maxCGIRedirects = 10
+)
+
+// cgiResponse is the header block of a CGI response, see RFC 3875 section 6.
+type cgiResponse struct {
+	status  int
+	headers http.Header
+	// localRedirect is the path the request is processed again with, the
+	// response body is discarded.
+	localRedirect string
+	// next calls the next handler with the response headers applied, the
+	// response body is discarded.
+	next bool
+}
+
+// splitCGIHeader returns the length of the CGI header block at the start of
+// the data, blank line included, and false while it is incomplete.
+func splitCGIHeader(data []byte) (int, bool, error) {
+	end, length := -1, 0
+
+	if i := bytes.Index(data, []byte("\r\n\r\n")); i >= 0 {
+		end, length = i, 4
+	}
+
+	if i := bytes.Index(data, []byte("\n\n")); i >= 0 && (end < 0 || i < end) {
+		end, length = i, 2
+	}
+
+	if end < 0 {
+		if len(data) > maxCGIHeader {
+			return 0, false, fmt.Errorf("%w: the header block exceeds %d bytes", ErrInvalidCGIResponse, maxCGIHeader)
+		}
+
+		return 0, false, nil
+	}
+
+	return end + length, true, nil
+}
+
+// parseCGIHeader reads the header block of a CGI response. The Status header
+// gives the response status, 200 by default or 302 with a Location header. A
+// lone Location header with a path is a local redirect, and the CGIActionHeader
+// continues the chain. The hop-by-hop headers are dropped.
+func parseCGIHeader(block []byte) (cgiResponse, error) {
+	reader := textproto.NewReader(bufio.NewReader(bytes.NewReader(block)))
+
+	mime, err := reader.ReadMIMEHeader()
+	if err != nil {
+		return cgiResponse{}, fmt.Errorf("%w: %w", ErrInvalidCGIResponse, err)
+	}
+
+	res := cgiResponse{headers: http.Header(mime), status: http.StatusOK}
+
+	for key := range res.headers {
+		if _, ok := hopByHopHeaders[key]; ok {
+			delete(res.headers, key)
+		}
+	}
+
+	if action := res.headers.Get(CGIActionHeader); action != "" {
+		if action != ActionContinue {
+			return cgiResponse{}, fmt.Errorf("%w: unknown action %q", ErrInvalidCGIResponse, action)
+		}
+
+		res.headers.Del(CGIActionHeader)
+		res.next = true
+
+		return res, nil
+	}
+
+	location := res.headers.Get("Location")
+
+	if value := res.headers.Get("Status"); value != "" {
+		code, _, _ := strings.Cut(strings.TrimSpace(value), " ")
+
+		res.status, err = strconv.Atoi(code)
+		if err != nil || len(code) != 3 || res.status < 200 || res.status > 599 {
+			return cgiResponse{}, fmt.Errorf("%w: invalid status %q", ErrInvalidCGIResponse, value)
+		}
+
+		res.headers.Del("Status")
+	} else if location != "" {
+		if strings.HasPrefix(location, "/") && len(res.headers) == 1 {
+			res.localRedirect = location
+
+			return res, nil
+		}
+
+		res.status = http.StatusFound
+	}
+
+	return res, nil
+}
+
+// writeCGIHeader writes the response header of a CGI header block. Nothing is
+// written for a local redirect, and only the headers are applied when the
+// chain continues.
+func writeCGIHeader(rw http.ResponseWriter, block []byte) (cgiResponse, error) {
+	res, err := parseCGIHeader(block)
+	if err != nil {
+		rw.WriteHeader(http.StatusBadGateway)
+
+		return cgiResponse{}, err
+	}
+
+	if res.localRedirect != "" {
+		return res, nil
+	}
+
+	applyHeaders(rw.Header(), res.headers)
+
+	if !res.next {
+		rw.WriteHeader(res.status)
+	}
+
+	return res, nil
+}
+
+// writeCGIResponse writes a whole CGI response, see writeCGIHeader.
+func writeCGIResponse(rw http.ResponseWriter, data []byte) (cgiResponse, error) {
+	n, ok, err := splitCGIHeader(data)
+	if err == nil && !ok {
+		err = fmt.Errorf("%w: missing header block", ErrInvalidCGIResponse)
+	}
+
+	if err != nil {
+		rw.WriteHeader(http.StatusBadGateway)
+
+		return cgiResponse{}, err
+	}
+
+	res, err := writeCGIHeader(rw, data[:n])
+	if err != nil || res.localRedirect != "" || res.next {
+		return res, err
+	}
+
+	_, err = rw.Write(data[n:])
+
+	return res, err
+}
+
+// localRedirect returns the request processed again for a local redirect, as
+// a GET request without body.
+func localRedirect(r *http.Request, location string) (*http.Request, error) {
+	u, err := url.ParseRequestURI(location)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid local redirect %q", ErrInvalidCGIResponse, location)
+	}
+
+	redirected := r.Clone(r.Context())
+	redirected.Method = http.MethodGet
+	redirected.URL = u
+	redirected.RequestURI = location
+	redirected.Body = http.NoBody
+	redirected.ContentLength = 0
+	redirected.Header.Del("Content-Length")
+	redirected.Header.Del("Content-Type")
+
+	return redirected, nil
+}
+
+// cgiServerSoftware is the SERVER_SOFTWARE of the CGI scripts.
+const cgiServerSoftware = "wazemmes"
+
+// cgiRequest is what a CGI script is run with, next to its HTTP request.
+type cgiRequest struct {
+	script       script
+	documentRoot string
+	// contentLength is the length of the body on the script stdin.
+	contentLength int64
+}
+
+// cgiEnv returns the environment of a CGI script, see RFC 3875 section 4.1.
+// The request headers are passed as HTTP_* variables with their values joined,
+// except the ones holding an underscore which would collide with the dashed
+// ones, and Proxy which would set HTTP_PROXY (httpoxy).
+func cgiEnv(r *http.Request, c cgiRequest) map[string]string {
+	env := map[string]string{
+		"GATEWAY_INTERFACE": "CGI/1.1",
+		"SERVER_SOFTWARE":   cgiServerSoftware,
+		"SERVER_PROTOCOL":   r.Proto,
+		"REQUEST_METHOD":    r.Method,
+		"REQUEST_URI":       r.RequestURI,
+		"REQUEST_SCHEME":    "http",
+		"QUERY_STRING":      r.URL.RawQuery,
+		"SCRIPT_NAME":       c.script.name,
+		"SCRIPT_FILENAME":   c.script.filename,
+		"DOCUMENT_ROOT":     c.documentRoot,
+		"CONTENT_TYPE":      r.Header.Get("Content-Type"),
+		"CONTENT_LENGTH":    "",
+	}
+
+	if r.RequestURI == "" {
+		env["REQUEST_URI"] = r.URL.RequestURI()
+	}
+
+	if c.contentLength > 0 {
+		env["CONTENT_LENGTH"] = strconv.FormatInt(c.contentLength, 10)
+	}
+
+	if c.script.pathInfo != "" {
+		env["PATH_INFO"] = c.script.pathInfo
+		env["PATH_TRANSLATED"] = path.Join(c.documentRoot, c.script.pathInfo)
+	}
+
+	if r.TLS != nil {
+		env["HTTPS"] = "on"
+		env["REQUEST_SCHEME"] = "https"
+	}
+
+	host, port := splitHostPort(r.Host)
+	env["SERVER_NAME"] = host
+	env["SERVER_PORT"] = port
+
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		env["SERVER_ADDR"], port = splitHostPort(addr.String())
+		if env["SERVER_PORT"] == "" {
+			env["SERVER_PORT"] = port
+		}
+	}
+
+	if env["SERVER_PORT"] == "" {
+		env["SERVER_PORT"] = "80"
+		if r.TLS != nil {
+			env["SERVER_PORT"] = "443"
+		}
+	}
+
+	env["REMOTE_ADDR"], env["REMOTE_PORT"] = splitHostPort(r.RemoteAddr)
+	env["REMOTE_HOST"] = env["REMOTE_ADDR"]
+
+	if scheme, _, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok {
+		env["AUTH_TYPE"] = scheme
+	}
+
+	if user, _, ok := r.BasicAuth(); ok {
+		env["REMOTE_USER"] = user
+	}
+
+	for key, values := range r.Header {
+		if strings.Contains(key, "_") || len(values) == 0 {
+			continue
+		}
+
+		name := strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+
+		switch name {
+		case "PROXY", "CONTENT_TYPE", "CONTENT_LENGTH":
+			continue
+		}
+
+		separator := ", "
+		if name == "COOKIE" {
+			separator = "; "
+		}
+
+		env["HTTP_"+name] = strings.Join(values, separator)
+	}
+
+	if r.Host != "" {
+		env["HTTP_HOST"] = r.Host
+	}
+
+	return env
+}
+
+// splitHostPort splits an address, the port is empty when it has none.
+func splitHostPort(addr string) (string, string) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, ""
+	}
+
+	return host, port
+}
+
+// cgiRunner runs the CGI modules of a builder, their response ends the chain.
+type cgiRunner struct {
+	runtime        wazero.Runtime
+	streamBody     bool
+	maxBodySize    int64
+	streamResponse bool
+}
+
+func newCGIRunner(runtime wazero.Runtime, o BuilderOptions) cgiRunner {
+	return cgiRunner{
+		runtime:        runtime,
+		streamBody:     o.StreamBody,
+		maxBodySize:    o.MaxBodySize,
+		streamResponse: o.StreamResponse,
+	}
+}
+
+// cgiRun is the module run for a request.
+type cgiRun struct {
+	// take returns the module instantiated ahead of the request.
+	take func(ctx context.Context) (*guestModule, error)
+	args []string
+	// env returns the CGI environment of the request, with the length of the
+	// body on the module stdin.
+	env func(contentLength int64) map[string]string
+}
+
+// serve runs the module routed for the request. The local redirects are
+// routed again, and the requests without route are passed to the next
+// handler, or get a 404 status.
+func (c *cgiRunner) serve(rw http.ResponseWriter, r *http.Request, next Handler, route func(*http.Request) (cgiRun, bool)) error {
+	for redirects := 0; ; redirects++ {
+		run, ok := route(r)
+		if !ok {
+			if next != nil {
+				return next.ServeHTTP(rw, r)
+			}
+
+			http.NotFound(rw, r)
+
+			return nil
+		}
+
+		location, err := c.run(rw, r, run, next)
+		if err != nil || location == "" {
+			return err
+		}
+
+		if redirects == maxCGIRedirects {
+			rw.WriteHeader(http.StatusInternalServerError)
+
+			return fmt.Errorf("%w: more than %d local redirects", ErrInvalidCGIResponse, maxCGIRedirects)
+		}
+
+		if r, err = localRedirect(r, location); err != nil {
+			rw.WriteHeader(http.StatusBadGateway)
+
+			return err
+		}
+	}
+}
+
+// run runs the module for the request and writes its response, it returns
+// the path of a local redirect instead. A module continuing the chain calls
+// the next handler with the request body replayed.
+func (c *cgiRunner) run(rw http.ResponseWriter, r *http.Request, run cgiRun, next Handler) (string, error) {
+	if !limitBody(rw, r, c.maxBodySize) {
+		return "", rejectBody(rw)
+	}
+
+	// The scripts read CONTENT_LENGTH bytes from their stdin, so only the
+	// bodies with a known length are streamed. The others are spooled first.
+	var (
+		stdin         io.Reader = http.NoBody
+		contentLength int64
+		finish        = func() error { return nil }
+		bodySpool     = &spool{}
+	)
+
+	defer func() {
+		_ = bodySpool.Close()
+	}()
+
+	switch {
+	case r.Body == nil || r.Body == http.NoBody:
+	case c.streamBody && r.ContentLength >= 0:
+		stdin, bodySpool, finish = streamBody(r)
+		contentLength = r.ContentLength
+	default:
+		if _, err := io.Copy(bodySpool, r.Body); err != nil {
+			if isBodyTooLarge(err) {
+				return "", rejectBody(rw)
+			}
+
+			return "", err
+		}
+
+		_ = r.Body.Close()
+		r.Body = bodySpool.reader()
+		stdin = bodySpool.reader()
+		contentLength = bodySpool.len()
+	}
+
+	outputBuffer := getBuffer()
+	defer putBuffer(outputBuffer)
+
+	var (
+		output    io.Writer = outputBuffer
+		streamed  *streamWriter
+		res       cgiResponse
+		streamErr error
+	)
+
+	// A streamed response is written once the script sent its header block,
+	// its flushes reach the client.
+	if c.streamResponse {
+		streamed = &streamWriter{
+			parse: splitCGIHeader,
+			onHeader: func(block []byte) (io.Writer, error) {
+				res, streamErr = writeCGIHeader(rw, block)
+				if streamErr != nil || res.localRedirect != "" || res.next {
+					return io.Discard, nil
+				}
+
+				return newFlushWriter(rw), nil
+			},
+		}
+		output = streamed
+	}
+
+	guest, err := run.take(r.Context())
+	if err != nil {
+		return "", fmt.Errorf("failed to instantiate WASM module: %w", err)
+	}
+
+	// The scripts exit with a non-zero code on errors, their output still
+	// describes the response.
+	var exitErr *sys.ExitError
+	err = guest.run(withProcess(r.Context(), run.args, run.env(contentLength)), stdin, output)
+
+	// An aborted guest exits too, the WasmHandler answers with the timeout
+	// status so nothing is written here.
+	if abortErr := guestAbortError(r.Context()); abortErr != nil {
+		return "", abortErr
+	}
+
+	// The rest of a streamed body is drained, a body exceeding the maximum
+	// size fails the script read too.
+	if isBodyTooLarge(finish()) {
+		if streamed != nil && streamed.started() {
+			return "", ErrBodyTooLarge
+		}
+
+		return "", rejectBody(rw)
+	}
+
+	if err != nil && !errors.As(err, &exitErr) {
+		return "", fmt.Errorf("failed to run WASM module: %w", err)
+	}
+
+	switch {
+	case streamed == nil:
+		res, err = writeCGIResponse(rw, outputBuffer.Bytes())
+	case streamed.started():
+		err = streamErr
+	default:
+		res, err = writeCGIResponse(rw, streamed.buf.Bytes())
+	}
+
+	if err != nil || !res.next || next == nil {
+		return res.localRedirect, err
+	}
+
+	return "", next.ServeHTTP(rw, r)
+}
@@ -0,0 +1,218 @@
+package wazemmes
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// serveGuest serves a request through the handler built with the options.
+func serveGuest(t *testing.T, builder string, options BuilderOptions, req *http.Request) (*httptest.ResponseRecorder, error) {
+	t.Helper()
+
+	return serveGuestWithNext(t, builder, options, req, nil)
+}
+
+// serveGuestWithNext serves a request through the handler built with the
+// options, then through next.
+func serveGuestWithNext(t *testing.T, builder string, options BuilderOptions, req *http.Request, next Handler) (*httptest.ResponseRecorder, error) {
+	t.Helper()
+
+	logger := zap.NewNop()
+	options.Logger = logger
+
+	h, err := NewWasmHandlerWithOptions(builder, options)
+	if err != nil {
+		t.Fatalf("impossible to build the handler: %v", err)
+	}
+
+	t.Cleanup(func() {
+		_ = h.Close(context.Background())
+	})
+
+	rec := httptest.NewRecorder()
+
+	return rec, BuildMiddlewareChainWithNext(logger, []*WasmHandler{h}, next).ServeHTTP(rec, req)
+}
+
+func TestCGITimeout(t *testing.T) {
+	for _, stream := range []bool{false, true} {
+		rec, err := serveGuest(t, "php", BuilderOptions{
+			Source:         NewFileSource("index.php"),
+			Interpreter:    buildGuest(t, "cgi"),
+			Timeout:        200 * time.Millisecond,
+			StreamResponse: stream,
+		}, httptest.NewRequest(http.MethodGet, "/slow", nil))
+
+		if !errors.Is(err, ErrGuestTimeout) {
+			t.Errorf("stream %t: got the error %v, expected %v", stream, err, ErrGuestTimeout)
+		}
+
+		if rec.Code != http.StatusGatewayTimeout {
+			t.Errorf("stream %t: got the status %d, expected %d", stream, rec.Code, http.StatusGatewayTimeout)
+		}
+	}
+}
+
+func TestCGIContinue(t *testing.T) {
+	for _, options := range []BuilderOptions{{}, {StreamBody: true, StreamResponse: true}} {
+		options.Source = NewFileSource("index.php")
+		options.Interpreter = buildGuest(t, "cgi")
+
+		var body []byte
+
+		next := HandlerFunc(func(rw http.ResponseWriter, req *http.Request) error {
+			body, _ = io.ReadAll(req.Body)
+			rw.WriteHeader(http.StatusAccepted)
+
+			return nil
+		})
+
+		rec, err := serveGuestWithNext(t, "php", options, httptest.NewRequest(http.MethodPost, "/continue", strings.NewReader("payload")), next)
+		if err != nil {
+			t.Fatalf("got the error %v", err)
+		}
+
+		if rec.Code != http.StatusAccepted || rec.Body.Len() != 0 {
+			t.Errorf("got the status %d and the body %q, expected the next handler response", rec.Code, rec.Body.String())
+		}
+
+		if got := rec.Header().Get("X-Guest"); got != "continued" {
+			t.Errorf("got the X-Guest header %q, expected continued", got)
+		}
+
+		if rec.Header().Get(CGIActionHeader) != "" {
+			t.Errorf("the %s header reached the client", CGIActionHeader)
+		}
+
+		if string(body) != "payload" {
+			t.Errorf("the next handler received the body %q, expected payload", body)
+		}
+	}
+}
+
+func TestCGIProcess(t *testing.T) {
+	logger := zap.NewNop()
+
+	h, err := NewWasmHandlerWithOptions("php", BuilderOptions{
+		Source:      NewFileSource("index.php"),
+		Interpreter: buildGuest(t, "cgi"),
+		Pool:        map[string]interface{}{"MaxTotal": 1},
+		Logger:      logger,
+	})
+	if err != nil {
+		t.Fatalf("impossible to build the handler: %v", err)
+	}
+
+	defer func() {
+		_ = h.Close(context.Background())
+	}()
+
+	// The single slot is instantiated again after each request, with the
+	// process of the next one.
+	for _, query := range []string{"a=1", "b=2"} {
+		rec := httptest.NewRecorder()
+
+		err = BuildMiddlewareChain(logger, []*WasmHandler{h}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/x.php?"+query, nil))
+		if err != nil {
+			t.Fatalf("got the error %v", err)
+		}
+
+		for _, expected := range []string{"QUERY_STRING=" + query + "\n", "TMPDIR=/tmp\n", `args=["php-cgi" "-c" "/etc/php/php.ini" "index.php"]`} {
+			if !strings.Contains(rec.Body.String(), expected) {
+				t.Errorf("the output %q doesn't contain %q", rec.Body.String(), expected)
+			}
+		}
+	}
+}
+
+func TestParseCGIHeader(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		block    string
+		status   int
+		redirect string
+		next     bool
+		headers  http.Header
+		err      bool
+	}{
+		{name: "default status", block: "Content-Type: text/html\n\n", status: http.StatusOK, headers: http.Header{"Content-Type": {"text/html"}}},
+		{name: "status", block: "Status: 404 Not Found\r\nContent-Type: text/plain\r\n\r\n", status: http.StatusNotFound, headers: http.Header{"Content-Type": {"text/plain"}}},
+		{name: "client redirect", block: "Location: https://example.com/\n\n", status: http.StatusFound, headers: http.Header{"Location": {"https://example.com/"}}},
+		{name: "redirect with headers", block: "Location: /login\nSet-Cookie: a=1\n\n", status: http.StatusFound, headers: http.Header{"Location": {"/login"}, "Set-Cookie": {"a=1"}}},
+		{name: "redirect with status", block: "Status: 301\nLocation: /moved\n\n", status: http.StatusMovedPermanently, headers: http.Header{"Location": {"/moved"}}},
+		{name: "local redirect", block: "Location: /index.php?x=1\n\n", status: http.StatusOK, redirect: "/index.php?x=1", headers: http.Header{"Location": {"/index.php?x=1"}}},
+		{name: "multiple values", block: "Set-Cookie: a=1\nSet-Cookie: b=2\n\n", status: http.StatusOK, headers: http.Header{"Set-Cookie": {"a=1", "b=2"}}},
+		{name: "hop-by-hop", block: "Connection: close\nTransfer-Encoding: chunked\nX-Kept: 1\n\n", status: http.StatusOK, headers: http.Header{"X-Kept": {"1"}}},
+		{name: "continue", block: CGIActionHeader + ": continue\nX-Guest: 1\n\n", status: http.StatusOK, next: true, headers: http.Header{"X-Guest": {"1"}}},
+		{name: "unknown action", block: CGIActionHeader + ": respond\n\n", err: true},
+		{name: "invalid status", block: "Status: 42\n\n", err: true},
+		{name: "status out of range", block: "Status: 600\n\n", err: true},
+		{name: "status not a number", block: "Status: OK\n\n", err: true},
+		{name: "malformed header", block: "no colon\n\n", err: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := parseCGIHeader([]byte(tc.block))
+			if tc.err {
+				if !errors.Is(err, ErrInvalidCGIResponse) {
+					t.Errorf("got the error %v, expected %v", err, ErrInvalidCGIResponse)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("got the error %v", err)
+			}
+
+			if res.status != tc.status || res.localRedirect != tc.redirect || res.next != tc.next {
+				t.Errorf("got the status %d, local redirect %q and next %t", res.status, res.localRedirect, res.next)
+			}
+
+			if !reflect.DeepEqual(res.headers, tc.headers) {
+				t.Errorf("got the headers %v, expected %v", res.headers, tc.headers)
+			}
+		})
+	}
+}
+
+func TestWriteCGIResponse(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		data   string
+		status int
+		body   string
+		header string
+		err    bool
+	}{
+		{name: "response", data: "Status: 201\nX-Guest: 1\n\nbody", status: http.StatusCreated, body: "body", header: "1"},
+		{name: "crlf", data: "X-Guest: 1\r\n\r\nbody\n\nrest", status: http.StatusOK, body: "body\n\nrest", header: "1"},
+		{name: "empty body", data: "X-Guest: 1\n\n", status: http.StatusOK, header: "1"},
+		{name: "local redirect", data: "Location: /other\n\nignored", status: http.StatusOK},
+		{name: "continue", data: CGIActionHeader + ": continue\nX-Guest: 1\n\nignored", status: http.StatusOK, header: "1"},
+		{name: "missing header block", data: "X-Guest: 1\nbody", status: http.StatusBadGateway, err: true},
+		{name: "invalid header block", data: "Status: 1000\n\nbody", status: http.StatusBadGateway, err: true},
+		{name: "header block too large", data: strings.Repeat("x", maxCGIHeader+1), status: http.StatusBadGateway, err: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+
+			_, err := writeCGIResponse(rec, []byte(tc.data))
+			if tc.err != errors.Is(err, ErrInvalidCGIResponse) {
+				t.Errorf("got the error %v", err)
+			}
+
+			if rec.Code != tc.status || rec.Body.String() != tc.body || rec.Header().Get("X-Guest") != tc.header {
+				t.Errorf("got the status %d, the body %q and the headers %v", rec.Code, rec.Body.String(), rec.Header())
+			}
+		})
+	}
+}
@@ -0,0 +1,338 @@
+package wazemmes
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// The encodings of the messages exchanged with the JS guests, selected per
+// module. The handshake is always encoded in JSON.
+const (
+	EncodingJSON = "json"
+	// EncodingBinary is a compact length-prefixed encoding, see binaryMagic.
+	EncodingBinary = "binary"
+)
+
+var ErrUnknownEncoding = errors.New("unknown encoding")
+
+// binaryMagic starts each binary message, so the guests and the host can tell
+// it apart from a JSON one.
+//
+// A binary message is made of big-endian uint32 lengths and their bytes:
+//
+//	message  = magic context:str version:u32 error:str action:str request response
+//	request  = method:str url:str headers body
+//	response = status:u32 headers trailers:headers body
+//	headers  = count:u32 { key:str values:u32 { value:str } }
+//	str      = length:u32 bytes
+//	body     = length:u32 bytes
+//
+// The absent headers, header values and bodies have the absent length, the
+// empty method and URL are absent too. The URL is always a string. An absent
+// request body in an input is streamed after the message.
+var binaryMagic = []byte("WZB1")
+
+const absent = math.MaxUint32
+
+type codec interface {
+	encode(buf *bytes.Buffer, input Input) error
+}
+
+func codecFor(encoding string) (codec, error) {
+	switch encoding {
+	case "", EncodingJSON:
+		return jsonCodec{}, nil
+	case EncodingBinary:
+		return binaryCodec{}, nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownEncoding, encoding)
+	}
+}
+
+// decodeOutput decodes the output in the encoding chosen by the guest, the
+// fields it omits keep their value.
+func decodeOutput(data []byte, output *Output) error {
+	if bytes.HasPrefix(data, binaryMagic) {
+		_, err := decodeBinary(data[len(binaryMagic):], output)
+
+		return err
+	}
+
+	err := json.NewDecoder(bytes.NewReader(data)).Decode(output)
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+
+	return err
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) encode(buf *bytes.Buffer, input Input) error {
+	return json.NewEncoder(buf).Encode(input)
+}
+
+type binaryCodec struct{}
+
+func (binaryCodec) encode(buf *bytes.Buffer, input Input) error {
+	w := binaryWriter{buf}
+
+	buf.Write(binaryMagic)
+	w.string(input.Context)
+	w.uint32(uint32(input.Version))
+	w.string(input.BaseHandler.Error)
+	w.string(input.BaseHandler.Action)
+
+	r := input.BaseHandler.Request
+	w.string(r.Method)
+
+	if r.URL != nil {
+		w.string(r.URL.String())
+	} else {
+		w.string("")
+	}
+
+	w.headers(r.Headers)
+
+	if r.Stream {
+		w.uint32(absent)
+	} else {
+		w.string(r.Body)
+	}
+
+	res := input.BaseHandler.Response
+	w.uint32(uint32(res.Status))
+	w.headers(res.Headers)
+	w.headers(res.Trailers)
+	w.string(res.Body)
+
+	return nil
+}
+
+type binaryWriter struct {
+	buf *bytes.Buffer
+}
+
+func (w binaryWriter) uint32(v uint32) {
+	w.buf.Write(binary.BigEndian.AppendUint32(w.buf.AvailableBuffer(), v))
+}
+
+func (w binaryWriter) string(s string) {
+	w.uint32(uint32(len(s)))
+	w.buf.WriteString(s)
+}
+
+func (w binaryWriter) headers(headers http.Header) {
+	if headers == nil {
+		w.uint32(absent)
+
+		return
+	}
+
+	w.uint32(uint32(len(headers)))
+
+	for key, values := range headers {
+		w.string(key)
+
+		if values == nil {
+			w.uint32(absent)
+
+			continue
+		}
+
+		w.uint32(uint32(len(values)))
+
+		for _, value := range values {
+			w.string(value)
+		}
+	}
+}
+
+var errTruncated = errors.New("truncated binary message")
+
+type binaryReader struct {
+	data []byte
+	err  error
+}
+
+func (r *binaryReader) uint32() uint32 {
+	if r.err != nil {
+		return 0
+	}
+
+	if len(r.data) < 4 {
+		r.err = errTruncated
+
+		return 0
+	}
+
+	v := binary.BigEndian.Uint32(r.data)
+	r.data = r.data[4:]
+
+	return v
+}
+
+// string returns false when the string is absent.
+func (r *binaryReader) string() (string, bool) {
+	length := r.uint32()
+	if r.err != nil || length == absent {
+		return "", false
+	}
+
+	if uint64(len(r.data)) < uint64(length) {
+		r.err = errTruncated
+
+		return "", false
+	}
+
+	s := string(r.data[:length])
+	r.data = r.data[length:]
+
+	return s, true
+}
+
+func (r *binaryReader) headers() http.Header {
+	count := r.uint32()
+	if r.err != nil || count == absent {
+		return nil
+	}
+
+	headers := make(http.Header, min(count, 64))
+
+	for range count {
+		key, _ := r.string()
+
+		values := r.uint32()
+		if r.err != nil {
+			return nil
+		}
+
+		if values == absent {
+			headers[key] = nil
+
+			continue
+		}
+
+		headers[key] = make([]string, 0, min(values, 64))
+
+		// Each value takes 4 bytes at least, a hostile count stops with the
+		// data.
+		for range values {
+			value, _ := r.string()
+			if r.err != nil {
+				return nil
+			}
+
+			headers[key] = append(headers[key], value)
+		}
+	}
+
+	return headers
+}
+
+// splitOutput decodes the output at the start of the data, it returns its
+// length with the newline following it, and false while it is incomplete.
+func splitOutput(data []byte, output *Output) (int, bool, error) {
+	if len(data) < len(binaryMagic) && bytes.HasPrefix(binaryMagic, data) {
+		return 0, false, nil
+	}
+
+	if bytes.HasPrefix(data, binaryMagic) {
+		n, err := decodeBinary(data[len(binaryMagic):], output)
+		if errors.Is(err, errTruncated) {
+			return 0, false, nil
+		}
+
+		return len(binaryMagic) + n, err == nil, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+
+	err := decoder.Decode(output)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return 0, false, nil
+	}
+
+	if err != nil {
+		return 0, false, err
+	}
+
+	n := int(decoder.InputOffset())
+	if n < len(data) && data[n] == '\n' {
+		n++
+	}
+
+	return n, true, nil
+}
+
+// decodeBinary returns the length of the decoded message.
+func decodeBinary(data []byte, output *Output) (int, error) {
+	r := &binaryReader{data: data}
+
+	_, _ = r.string()
+	output.Version = int(r.uint32())
+	output.Error, _ = r.string()
+	output.Action, _ = r.string()
+
+	if method, _ := r.string(); method != "" {
+		output.Request.Method = method
+	}
+
+	rawURL, _ := r.string()
+	if headers := r.headers(); headers != nil {
+		output.Request.Headers = headers
+	}
+
+	if body, ok := r.string(); ok {
+		output.Request.Body = body
+		output.Request.bodySet = true
+	}
+
+	output.Response.Status = int(r.uint32())
+	output.Response.Headers = r.headers()
+	output.Response.Trailers = r.headers()
+	output.Response.Body, _ = r.string()
+
+	if r.err != nil {
+		return 0, r.err
+	}
+
+	if rawURL != "" {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return 0, fmt.Errorf("invalid guest URL: %w", err)
+		}
+
+		output.Request.URL = u
+	}
+
+	return len(data) - len(r.data), nil
+}
+
+var buffers = sync.Pool{
+	New: func() any {
+		return new(bytes.Buffer)
+	},
+}
+
+func getBuffer() *bytes.Buffer {
+	return buffers.Get().(*bytes.Buffer)
+}
+
+// putBuffer drops the large buffers instead of keeping them alive.
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > 1<<20 {
+		return
+	}
+
+	buf.Reset()
+	buffers.Put(buf)
+}
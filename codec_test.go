@@ -0,0 +1,241 @@
+package wazemmes
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func binaryInput() Input {
+	return Input{
+		BaseHandler: baseHandler{
+			Request: request{
+				Headers: http.Header{"Accept": {"text/html", "application/json"}, "X-Removed": nil},
+				URL:     &url.URL{Path: "/binary", RawQuery: "x=1"},
+				Body:    "\x89PNG\x00\xff",
+				Method:  http.MethodPost,
+			},
+			Response: response{
+				Headers:  http.Header{"Content-Type": {"image/png"}},
+				Trailers: http.Header{"X-Checksum": {"1234"}},
+				Body:     "\x00\x01",
+				Status:   http.StatusCreated,
+			},
+			Error:  "failure",
+			Action: ActionRespond,
+		},
+		Context: "request",
+		Version: ProtocolVersion,
+	}
+}
+
+func encodeBinary(t *testing.T, input Input) []byte {
+	t.Helper()
+
+	buf := new(bytes.Buffer)
+	if err := (binaryCodec{}).encode(buf, input); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestBinaryCodecRoundTrip(t *testing.T) {
+	input := binaryInput()
+
+	var output Output
+	if err := decodeOutput(encodeBinary(t, input), &output); err != nil {
+		t.Fatalf("got the error %v", err)
+	}
+
+	expected := input.BaseHandler
+	expected.Request.bodySet = true
+	expected.Version = ProtocolVersion
+
+	if !reflect.DeepEqual(output, expected) {
+		t.Errorf("got the output %+v, expected %+v", output, expected)
+	}
+}
+
+func TestBinaryCodecStream(t *testing.T) {
+	input := binaryInput()
+	input.BaseHandler.Request.Stream = true
+
+	output := Output{Request: request{Body: "kept"}}
+	if err := decodeOutput(encodeBinary(t, input), &output); err != nil {
+		t.Fatalf("got the error %v", err)
+	}
+
+	if output.Request.bodySet || output.Request.Body != "kept" {
+		t.Errorf("the absent body replaced the body with %q", output.Request.Body)
+	}
+}
+
+func TestBinaryCodecTruncated(t *testing.T) {
+	data := encodeBinary(t, binaryInput())
+
+	for n := range len(data) {
+		var output Output
+
+		size, complete, err := splitOutput(data[:n], &output)
+		if complete || err != nil || size != 0 {
+			t.Fatalf("the %d first bytes are decoded as a message of %d bytes, complete %t, error %v", n, size, complete, err)
+		}
+
+		if n >= len(binaryMagic) {
+			if _, err = decodeBinary(data[len(binaryMagic):n], &output); !errors.Is(err, errTruncated) {
+				t.Fatalf("the %d first bytes got the error %v, expected %v", n, err, errTruncated)
+			}
+		}
+	}
+
+	var output Output
+	if size, complete, err := splitOutput(append(data, '{'), &output); !complete || err != nil || size != len(data) {
+		t.Errorf("the message is decoded as %d bytes, complete %t, error %v", size, complete, err)
+	}
+}
+
+func TestBinaryCodecHostileLengths(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		message func(w binaryWriter)
+	}{
+		{
+			name: "string",
+			message: func(w binaryWriter) {
+				w.uint32(absent - 1)
+			},
+		},
+		{
+			name: "header count",
+			message: func(w binaryWriter) {
+				w.string("request")
+				w.uint32(ProtocolVersion)
+				w.string("")
+				w.string("")
+				w.string(http.MethodGet)
+				w.string("/")
+				w.uint32(absent - 1)
+			},
+		},
+		{
+			name: "header values",
+			message: func(w binaryWriter) {
+				w.string("request")
+				w.uint32(ProtocolVersion)
+				w.string("")
+				w.string("")
+				w.string(http.MethodGet)
+				w.string("/")
+				w.uint32(1)
+				w.string("Accept")
+				w.uint32(absent - 1)
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			buf := new(bytes.Buffer)
+			tc.message(binaryWriter{buf})
+
+			var output Output
+			if _, err := decodeBinary(buf.Bytes(), &output); !errors.Is(err, errTruncated) {
+				t.Errorf("got the error %v, expected %v", err, errTruncated)
+			}
+		})
+	}
+}
+
+// benchmarkInput is a request input with a body of the size.
+func benchmarkInput(size int) Input {
+	return Input{
+		BaseHandler: baseHandler{
+			Request: request{
+				Headers: http.Header{
+					"Accept":     {"text/html", "application/json"},
+					"Cookie":     {"session=0123456789abcdef"},
+					"User-Agent": {"wazemmes-bench"},
+				},
+				URL:    &url.URL{Path: "/bench", RawQuery: "x=1"},
+				Body:   string(bytes.Repeat([]byte{'x'}, size)),
+				Method: http.MethodPost,
+			},
+			Response: response{Headers: http.Header{}},
+		},
+		Context: "request",
+		Version: ProtocolVersion,
+	}
+}
+
+// benchmarkCodec runs the encoding of a request input, the decoding of the
+// encoded input as a guest output, or both, for several body sizes.
+func benchmarkCodec(b *testing.B, encoding string, encode, decode bool) {
+	encoder, err := codecFor(encoding)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, size := range []int{0, 1 << 10, 64 << 10, 1 << 20} {
+		b.Run(fmt.Sprintf("body=%d", size), func(b *testing.B) {
+			input := benchmarkInput(size)
+
+			buf := new(bytes.Buffer)
+			if err := encoder.encode(buf, input); err != nil {
+				b.Fatal(err)
+			}
+
+			encoded := bytes.Clone(buf.Bytes())
+
+			b.ReportAllocs()
+			b.SetBytes(int64(size))
+
+			for b.Loop() {
+				data := encoded
+
+				if encode {
+					buf.Reset()
+
+					if err := encoder.encode(buf, input); err != nil {
+						b.Fatal(err)
+					}
+
+					data = buf.Bytes()
+				}
+
+				if decode {
+					var output Output
+					if err := decodeOutput(data, &output); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkEncodeJSON(b *testing.B) {
+	benchmarkCodec(b, EncodingJSON, true, false)
+}
+
+func BenchmarkEncodeBinary(b *testing.B) {
+	benchmarkCodec(b, EncodingBinary, true, false)
+}
+
+func BenchmarkDecodeJSON(b *testing.B) {
+	benchmarkCodec(b, EncodingJSON, false, true)
+}
+
+func BenchmarkDecodeBinary(b *testing.B) {
+	benchmarkCodec(b, EncodingBinary, false, true)
+}
+
+func BenchmarkRoundTripJSON(b *testing.B) {
+	benchmarkCodec(b, EncodingJSON, true, true)
+}
+
+func BenchmarkRoundTripBinary(b *testing.B) {
+	benchmarkCodec(b, EncodingBinary, true, true)
+}
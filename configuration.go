@@ -11,11 +11,20 @@ type configuration struct {
 	Pool pool.ObjectPoolConfig `json:"pool"`
 }
 
-func newPoolConfiguration(value any, poolConfiguration map[string]interface{}) *pool.ObjectPool {
-	factory := pool.NewPooledObjectFactorySimple(
-		func(context.Context) (interface{}, error) {
-			return value, nil
-		})
+// newPoolConfiguration creates the pool of guest instances. One instance is
+// created eagerly to fail fast, then the pool is filled up to MinIdle.
+func newPoolConfiguration(newInstance func(context.Context) (instance, error), poolConfiguration map[string]interface{}) (*pool.ObjectPool, error) {
+	factory := pool.NewPooledObjectFactory(
+		func(ctx context.Context) (interface{}, error) {
+			return newInstance(ctx)
+		},
+		func(ctx context.Context, object *pool.PooledObject) error {
+			return object.Object.(instance).Close(ctx)
+		},
+		nil,
+		nil,
+		nil,
+	)
 
 	poolConfig := pool.NewDefaultPoolConfig()
 	if poolConfiguration != nil {
@@ -24,5 +33,15 @@ func newPoolConfiguration(value any, poolConfiguration map[string]interface{}) *
 	}
 
 	ctx := context.Background()
-	return pool.NewObjectPool(ctx, factory, poolConfig)
+	objectPool := pool.NewObjectPool(ctx, factory, poolConfig)
+
+	if err := objectPool.AddObject(withoutQueue(ctx)); err != nil {
+		objectPool.Close(ctx)
+
+		return nil, err
+	}
+
+	objectPool.PreparePool(withoutQueue(ctx))
+
+	return objectPool, nil
 }
@@ -0,0 +1,48 @@
+//go:build wasip1
+
+// Command cgiguest is the reference conformance guest of the CGI builders,
+// build it with GOOS=wasip1 GOARCH=wasm and run the CGI suite against it with
+// the cgi builder, or with the php builder as interpreter.
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+func main() {
+	body, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		os.Exit(1)
+	}
+
+	uri := os.Getenv("REQUEST_URI")
+
+	// The rewrite is a local redirect, the host runs the guest again with the
+	// rewritten URI.
+	if rewrite := os.Getenv("HTTP_X_CONFORMANCE_REWRITE"); rewrite != "" && rewrite != uri {
+		fmt.Printf("Location: %s\n\n", rewrite)
+
+		return
+	}
+
+	fmt.Printf("X-Conformance-Url: %s\n", uri)
+	fmt.Print("Set-Cookie: a=1\nSet-Cookie: b=2\n")
+
+	if status := os.Getenv("HTTP_X_CONFORMANCE_STATUS"); status != "" {
+		fmt.Printf("Status: %s\n", status)
+	}
+
+	if location := os.Getenv("HTTP_X_CONFORMANCE_LOCATION"); location != "" {
+		fmt.Printf("Location: %s\n", location)
+	}
+
+	// The CGI responses end the chain unless the guest continues it.
+	if os.Getenv("HTTP_X_CONFORMANCE_ACTION") == "continue" {
+		fmt.Print("X-Wazemmes-Action: continue\n")
+	}
+
+	fmt.Print("\n")
+	_, _ = os.Stdout.Write(body)
+}
@@ -0,0 +1,391 @@
+// Package conformance checks that a builder and its guests speak the JSON
+// protocol of the non http-wasm guests the way the host expects it.
+//
+// The suite runs against a conformance guest, see the guest command for the
+// reference one. In the request context, a conformance guest:
+//   - answers the handshake with the version 2 of the protocol,
+//   - responds with the request body and its bodyEncoding,
+//   - sets the X-Conformance-Url response header to the request URL, and the
+//     a=1 and b=2 values of the Set-Cookie header,
+//   - uses the X-Conformance-Status request header as the response status,
+//   - uses the X-Conformance-Location request header as the response Location,
+//   - uses the X-Conformance-Rewrite request header as the request URL,
+//   - uses the X-Conformance-Action request header as the output action.
+//
+// In the response context, it returns its input unchanged.
+//
+// The CGI builders run a CGI conformance guest instead, see the cgiguest
+// command. It answers with the same headers and body, reads the conformance
+// headers from the HTTP_X_CONFORMANCE_* variables, continues the chain with
+// the CGIActionHeader for the continue action, and rewrites the request with
+// a local redirect. Its responses end the chain unless it continues it.
+package conformance
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/darkweak/wazemmes"
+	"go.uber.org/zap"
+)
+
+// downstream records the request received by the next handler.
+type downstream struct {
+	called bool
+	url    string
+	body   []byte
+}
+
+func (d *downstream) ServeHTTP(_ http.ResponseWriter, req *http.Request) error {
+	d.called = true
+	d.url = req.URL.String()
+	d.body, _ = io.ReadAll(req.Body)
+
+	return nil
+}
+
+type testCase struct {
+	name    string
+	method  string
+	url     string
+	body    []byte
+	headers map[string]string
+	// fails when the guest output is rejected by the host.
+	fails bool
+	check func(t *testing.T, rec *httptest.ResponseRecorder, next *downstream)
+}
+
+var binaryBody = []byte{0x89, 'P', 'N', 'G', 0x00, 0xff, 0xfe}
+
+var cases = []testCase{
+	{
+		name:   "echo",
+		method: http.MethodPost,
+		url:    "/conformance",
+		body:   []byte("hello"),
+		check: func(t *testing.T, rec *httptest.ResponseRecorder, next *downstream) {
+			expectStatus(t, rec, http.StatusOK)
+			expectBody(t, rec, []byte("hello"))
+
+			if !next.called {
+				t.Error("the next handler wasn't called")
+			}
+		},
+	},
+	{
+		name:   "binary body",
+		method: http.MethodPost,
+		url:    "/conformance",
+		body:   binaryBody,
+		check: func(t *testing.T, rec *httptest.ResponseRecorder, next *downstream) {
+			expectBody(t, rec, binaryBody)
+
+			if !bytes.Equal(next.body, binaryBody) {
+				t.Errorf("the next handler received the body %q, expected %q", next.body, binaryBody)
+			}
+		},
+	},
+	{
+		name:   "url",
+		method: http.MethodGet,
+		url:    "/conformance?x=1",
+		check: func(t *testing.T, rec *httptest.ResponseRecorder, _ *downstream) {
+			if got := rec.Header().Get("X-Conformance-Url"); got != "/conformance?x=1" {
+				t.Errorf("the guest received the URL %q, expected /conformance?x=1", got)
+			}
+		},
+	},
+	{
+		name:    "status and headers",
+		method:  http.MethodGet,
+		url:     "/conformance",
+		headers: map[string]string{"X-Conformance-Status": "201"},
+		check: func(t *testing.T, rec *httptest.ResponseRecorder, _ *downstream) {
+			expectStatus(t, rec, http.StatusCreated)
+
+			if got := rec.Header().Values("Set-Cookie"); !slices.Equal(got, []string{"a=1", "b=2"}) {
+				t.Errorf("got the Set-Cookie values %q, expected [a=1 b=2]", got)
+			}
+		},
+	},
+	{
+		name:    "invalid status",
+		method:  http.MethodGet,
+		url:     "/conformance",
+		headers: map[string]string{"X-Conformance-Status": "42"},
+		fails:   true,
+		check: func(t *testing.T, rec *httptest.ResponseRecorder, next *downstream) {
+			expectStatus(t, rec, http.StatusInternalServerError)
+
+			if next.called {
+				t.Error("the next handler was called after an invalid guest response")
+			}
+		},
+	},
+	{
+		name:    "rewrite",
+		method:  http.MethodGet,
+		url:     "/conformance",
+		headers: map[string]string{"X-Conformance-Rewrite": "/rewritten?y=2"},
+		check: func(t *testing.T, _ *httptest.ResponseRecorder, next *downstream) {
+			if next.url != "/rewritten?y=2" {
+				t.Errorf("the next handler received the URL %q, expected /rewritten?y=2", next.url)
+			}
+		},
+	},
+	{
+		name:    "continue",
+		method:  http.MethodPost,
+		url:     "/conformance",
+		body:    []byte("hello"),
+		headers: map[string]string{"X-Conformance-Action": wazemmes.ActionContinue},
+		check: func(t *testing.T, rec *httptest.ResponseRecorder, next *downstream) {
+			expectBody(t, rec, nil)
+
+			if !next.called {
+				t.Error("the next handler wasn't called")
+			}
+		},
+	},
+	{
+		name:   "respond",
+		method: http.MethodPost,
+		url:    "/conformance",
+		body:   []byte("denied"),
+		headers: map[string]string{
+			"X-Conformance-Action": wazemmes.ActionRespond,
+			"X-Conformance-Status": "401",
+		},
+		check: func(t *testing.T, rec *httptest.ResponseRecorder, next *downstream) {
+			expectStatus(t, rec, http.StatusUnauthorized)
+			expectBody(t, rec, []byte("denied"))
+
+			if next.called {
+				t.Error("the next handler was called after the guest responded")
+			}
+		},
+	},
+	{
+		name:   "redirect",
+		method: http.MethodGet,
+		url:    "/conformance",
+		headers: map[string]string{
+			"X-Conformance-Action":   wazemmes.ActionRedirect,
+			"X-Conformance-Location": "/login",
+		},
+		check: func(t *testing.T, rec *httptest.ResponseRecorder, next *downstream) {
+			expectStatus(t, rec, http.StatusFound)
+
+			if got := rec.Header().Get("Location"); got != "/login" {
+				t.Errorf("got the Location %q, expected /login", got)
+			}
+
+			if next.called {
+				t.Error("the next handler was called after the guest redirected")
+			}
+		},
+	},
+}
+
+var cgiCases = []testCase{
+	{
+		name:   "echo",
+		method: http.MethodPost,
+		url:    "/conformance",
+		body:   []byte("hello"),
+		check: func(t *testing.T, rec *httptest.ResponseRecorder, next *downstream) {
+			expectStatus(t, rec, http.StatusOK)
+			expectBody(t, rec, []byte("hello"))
+
+			if next.called {
+				t.Error("the next handler was called after the guest responded")
+			}
+		},
+	},
+	{
+		name:   "binary body",
+		method: http.MethodPost,
+		url:    "/conformance",
+		body:   binaryBody,
+		check: func(t *testing.T, rec *httptest.ResponseRecorder, _ *downstream) {
+			expectBody(t, rec, binaryBody)
+		},
+	},
+	{
+		name:   "url",
+		method: http.MethodGet,
+		url:    "/conformance?x=1",
+		check: func(t *testing.T, rec *httptest.ResponseRecorder, _ *downstream) {
+			if got := rec.Header().Get("X-Conformance-Url"); got != "/conformance?x=1" {
+				t.Errorf("the guest received the URL %q, expected /conformance?x=1", got)
+			}
+		},
+	},
+	{
+		name:    "status and headers",
+		method:  http.MethodGet,
+		url:     "/conformance",
+		headers: map[string]string{"X-Conformance-Status": "201"},
+		check: func(t *testing.T, rec *httptest.ResponseRecorder, _ *downstream) {
+			expectStatus(t, rec, http.StatusCreated)
+
+			if got := rec.Header().Values("Set-Cookie"); !slices.Equal(got, []string{"a=1", "b=2"}) {
+				t.Errorf("got the Set-Cookie values %q, expected [a=1 b=2]", got)
+			}
+		},
+	},
+	{
+		name:    "invalid status",
+		method:  http.MethodGet,
+		url:     "/conformance",
+		headers: map[string]string{"X-Conformance-Status": "42"},
+		fails:   true,
+		check: func(t *testing.T, rec *httptest.ResponseRecorder, next *downstream) {
+			expectStatus(t, rec, http.StatusBadGateway)
+
+			if next.called {
+				t.Error("the next handler was called after an invalid guest response")
+			}
+		},
+	},
+	{
+		name:    "rewrite",
+		method:  http.MethodGet,
+		url:     "/conformance",
+		headers: map[string]string{"X-Conformance-Rewrite": "/rewritten?y=2"},
+		check: func(t *testing.T, rec *httptest.ResponseRecorder, _ *downstream) {
+			if got := rec.Header().Get("X-Conformance-Url"); got != "/rewritten?y=2" {
+				t.Errorf("the guest ran again with the URL %q, expected /rewritten?y=2", got)
+			}
+		},
+	},
+	{
+		name:    "continue",
+		method:  http.MethodPost,
+		url:     "/conformance",
+		body:    []byte("hello"),
+		headers: map[string]string{"X-Conformance-Action": wazemmes.ActionContinue},
+		check: func(t *testing.T, rec *httptest.ResponseRecorder, next *downstream) {
+			expectBody(t, rec, nil)
+
+			if !next.called {
+				t.Fatal("the next handler wasn't called")
+			}
+
+			if !bytes.Equal(next.body, []byte("hello")) {
+				t.Errorf("the next handler received the body %q, expected hello", next.body)
+			}
+
+			if got := rec.Header().Values("Set-Cookie"); !slices.Equal(got, []string{"a=1", "b=2"}) {
+				t.Errorf("got the Set-Cookie values %q, expected [a=1 b=2]", got)
+			}
+		},
+	},
+	{
+		name:   "respond",
+		method: http.MethodPost,
+		url:    "/conformance",
+		body:   []byte("denied"),
+		headers: map[string]string{
+			"X-Conformance-Status": "401",
+		},
+		check: func(t *testing.T, rec *httptest.ResponseRecorder, _ *downstream) {
+			expectStatus(t, rec, http.StatusUnauthorized)
+			expectBody(t, rec, []byte("denied"))
+		},
+	},
+	{
+		name:    "redirect",
+		method:  http.MethodGet,
+		url:     "/conformance",
+		headers: map[string]string{"X-Conformance-Location": "/login"},
+		check: func(t *testing.T, rec *httptest.ResponseRecorder, _ *downstream) {
+			expectStatus(t, rec, http.StatusFound)
+
+			if got := rec.Header().Get("Location"); got != "/login" {
+				t.Errorf("got the Location %q, expected /login", got)
+			}
+		},
+	},
+}
+
+func expectStatus(t *testing.T, rec *httptest.ResponseRecorder, status int) {
+	t.Helper()
+
+	if rec.Code != status {
+		t.Errorf("got the status %d, expected %d", rec.Code, status)
+	}
+}
+
+func expectBody(t *testing.T, rec *httptest.ResponseRecorder, body []byte) {
+	t.Helper()
+
+	if !bytes.Equal(rec.Body.Bytes(), body) {
+		t.Errorf("got the body %q, expected %q", rec.Body.Bytes(), body)
+	}
+}
+
+// Run builds the conformance guest with the builder and runs the suite
+// against it, each case is a subtest.
+func Run(t *testing.T, builder string, source wazemmes.ModuleSource) {
+	t.Helper()
+
+	RunWithOptions(t, builder, wazemmes.BuilderOptions{Source: source})
+}
+
+// RunWithOptions runs the suite against the conformance guest built with the
+// options, to check an encoding for example.
+func RunWithOptions(t *testing.T, builder string, options wazemmes.BuilderOptions) {
+	t.Helper()
+
+	run(t, builder, options, cases)
+}
+
+// RunCGI runs the CGI suite against the CGI conformance guest built with the
+// options, its module is the Source of the cgi builder or the Interpreter of
+// the php one.
+func RunCGI(t *testing.T, builder string, options wazemmes.BuilderOptions) {
+	t.Helper()
+
+	run(t, builder, options, cgiCases)
+}
+
+func run(t *testing.T, builder string, options wazemmes.BuilderOptions, cases []testCase) {
+	t.Helper()
+
+	logger := zap.NewNop()
+	options.Logger = logger
+
+	handler, err := wazemmes.NewWasmHandlerWithOptions(builder, options)
+	if err != nil {
+		t.Fatalf("impossible to build the conformance guest: %v", err)
+	}
+
+	t.Cleanup(func() {
+		_ = handler.Close(context.Background())
+	})
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.url, bytes.NewReader(tc.body))
+			for key, value := range tc.headers {
+				req.Header.Set(key, value)
+			}
+
+			rec := httptest.NewRecorder()
+			next := &downstream{}
+
+			chain := wazemmes.BuildMiddlewareChainWithNext(logger, []*wazemmes.WasmHandler{handler}, next)
+			if err := chain.ServeHTTP(rec, req); (err != nil) != tc.fails {
+				t.Errorf("the chain returned %v", err)
+			}
+
+			tc.check(t, rec, next)
+		})
+	}
+}
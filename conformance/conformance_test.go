@@ -0,0 +1,93 @@
+package conformance_test
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/darkweak/wazemmes"
+	"github.com/darkweak/wazemmes/conformance"
+)
+
+// buildGuest builds the guest command of the directory for wasip1, the test
+// is skipped without a go command.
+func buildGuest(t *testing.T, dir string) wazemmes.ModuleSource {
+	t.Helper()
+
+	goBin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("the go command is needed to build the conformance guests")
+	}
+
+	output := filepath.Join(t.TempDir(), dir+".wasm")
+
+	cmd := exec.Command(goBin, "build", "-o", output, "./"+dir)
+	cmd.Env = append(os.Environ(), "GOOS=wasip1", "GOARCH=wasm")
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("impossible to build the %s conformance guest: %v\n%s", dir, err, out)
+	}
+
+	return wazemmes.NewFileSource(output)
+}
+
+// TestBuilders runs the suite of its protocol for every registered builder.
+func TestBuilders(t *testing.T) {
+	guest, cgiGuest := buildGuest(t, "guest"), buildGuest(t, "cgiguest")
+
+	for _, builder := range wazemmes.Builders() {
+		t.Run(builder, func(t *testing.T) {
+			switch builder {
+			case "go", "golang", "tinygo", "http-wasm":
+				t.Skip("the http-wasm guests speak the http-wasm ABI, the conformance suites cover the stdio protocols")
+			case "php":
+				for name, options := range cgiVariants() {
+					t.Run(name, func(t *testing.T) {
+						options.Source = wazemmes.NewFileSource("index.php")
+						options.Interpreter = cgiGuest
+						conformance.RunCGI(t, builder, options)
+					})
+				}
+			case "cgi", "wagi":
+				for name, options := range cgiVariants() {
+					t.Run(name, func(t *testing.T) {
+						options.Source = cgiGuest
+						conformance.RunCGI(t, builder, options)
+					})
+				}
+			case "js", "javascript", "asc", "assemblyscript", wazemmes.AutoBuilder:
+				for name, options := range variants() {
+					t.Run(name, func(t *testing.T) {
+						options.Source = guest
+						conformance.RunWithOptions(t, builder, options)
+					})
+				}
+			default:
+				t.Errorf("the %s builder has no conformance guest", builder)
+			}
+		})
+	}
+}
+
+// variants are the options the stdio guests are checked with.
+func variants() map[string]wazemmes.BuilderOptions {
+	return map[string]wazemmes.BuilderOptions{
+		"json":   {Encoding: wazemmes.EncodingJSON},
+		"binary": {Encoding: wazemmes.EncodingBinary},
+		"stream": {StreamBody: true, StreamResponse: true},
+		"binary stream": {
+			Encoding:       wazemmes.EncodingBinary,
+			StreamBody:     true,
+			StreamResponse: true,
+		},
+	}
+}
+
+// cgiVariants are the options the CGI guests are checked with.
+func cgiVariants() map[string]wazemmes.BuilderOptions {
+	return map[string]wazemmes.BuilderOptions{
+		"buffered": {},
+		"stream":   {StreamBody: true, StreamResponse: true},
+	}
+}
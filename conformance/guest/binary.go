@@ -0,0 +1,143 @@
+//go:build wasip1
+
+package main
+
+import (
+	"encoding/binary"
+	"net/http"
+)
+
+// magic starts the messages in the binary encoding of the host, the bodies
+// are raw bytes so they are never base64 encoded.
+var magic = []byte("WZB1")
+
+const absent = 0xFFFFFFFF
+
+type reader struct {
+	data []byte
+}
+
+func (r *reader) uint32() uint32 {
+	if len(r.data) < 4 {
+		r.data = nil
+
+		return 0
+	}
+
+	v := binary.BigEndian.Uint32(r.data)
+	r.data = r.data[4:]
+
+	return v
+}
+
+func (r *reader) string() string {
+	length := r.uint32()
+	if length == absent || int(length) > len(r.data) {
+		return ""
+	}
+
+	s := string(r.data[:length])
+	r.data = r.data[length:]
+
+	return s
+}
+
+func (r *reader) headers() http.Header {
+	count := r.uint32()
+	if count == absent {
+		return nil
+	}
+
+	headers := http.Header{}
+
+	for range count {
+		key := r.string()
+
+		values := r.uint32()
+		if values == absent {
+			continue
+		}
+
+		for range values {
+			headers[key] = append(headers[key], r.string())
+		}
+	}
+
+	return headers
+}
+
+// decode returns the message and the bytes following it.
+func decode(data []byte) (message, []byte) {
+	r := &reader{data: data}
+
+	var m message
+	m.Context = r.string()
+	m.Version = int(r.uint32())
+	m.Error = r.string()
+	m.Action = r.string()
+	m.Request.Method = r.string()
+	m.Request.URL = r.string()
+	m.Request.Headers = r.headers()
+
+	// An absent request body is streamed after the message.
+	if len(r.data) >= 4 && binary.BigEndian.Uint32(r.data) == absent {
+		r.uint32()
+		m.Request.Stream = true
+	} else {
+		m.Request.Body = r.string()
+	}
+	m.Response.Status = int(r.uint32())
+	m.Response.Headers = r.headers()
+	m.Response.Trailers = r.headers()
+	m.Response.Body = r.string()
+
+	return m, r.data
+}
+
+type writer []byte
+
+func (w *writer) uint32(v uint32) {
+	*w = binary.BigEndian.AppendUint32(*w, v)
+}
+
+func (w *writer) string(s string) {
+	w.uint32(uint32(len(s)))
+	*w = append(*w, s...)
+}
+
+func (w *writer) headers(headers http.Header) {
+	if headers == nil {
+		w.uint32(absent)
+
+		return
+	}
+
+	w.uint32(uint32(len(headers)))
+
+	for key, values := range headers {
+		w.string(key)
+		w.uint32(uint32(len(values)))
+
+		for _, value := range values {
+			w.string(value)
+		}
+	}
+}
+
+func encode(m message) []byte {
+	w := writer(append([]byte{}, magic...))
+	w.string(m.Context)
+	w.uint32(uint32(m.Version))
+	w.string(m.Error)
+	w.string(m.Action)
+	w.string(m.Request.Method)
+	w.string(m.Request.URL)
+	w.headers(m.Request.Headers)
+	w.string(m.Request.Body)
+	w.uint32(uint32(m.Response.Status))
+	w.headers(m.Response.Headers)
+	w.headers(m.Response.Trailers)
+	w.string(m.Response.Body)
+
+	return w
+}
@@ -0,0 +1,126 @@
+//go:build wasip1
+
+// Command guest is the reference conformance guest of the JSON protocol, build
+// it with GOOS=wasip1 GOARCH=wasm and run the conformance suite against it
+// with the js builder.
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"unicode/utf8"
+)
+
+type request struct {
+	Headers      http.Header `json:"headers"`
+	URL          string      `json:"url"`
+	Body         string      `json:"body"`
+	BodyEncoding string      `json:"bodyEncoding,omitempty"`
+	Method       string      `json:"method"`
+	Stream       bool        `json:"stream,omitempty"`
+}
+
+type response struct {
+	Headers      http.Header `json:"headers"`
+	Trailers     http.Header `json:"trailers,omitempty"`
+	Body         string      `json:"body"`
+	BodyEncoding string      `json:"bodyEncoding,omitempty"`
+	Status       int         `json:"status"`
+}
+
+type message struct {
+	Context  string   `json:"context,omitempty"`
+	Version  int      `json:"version,omitempty"`
+	Request  request  `json:"request"`
+	Response response `json:"response"`
+	Error    string   `json:"error"`
+	Action   string   `json:"action,omitempty"`
+}
+
+func main() {
+	data, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		os.Exit(1)
+	}
+
+	var input message
+
+	// A streamed body follows the message.
+	var rest []byte
+
+	binaryEncoded := bytes.HasPrefix(data, magic)
+	if binaryEncoded {
+		input, rest = decode(data[len(magic):])
+	} else {
+		message := data
+		if newline := bytes.IndexByte(data, '\n'); newline >= 0 {
+			message, rest = data[:newline], data[newline+1:]
+		}
+
+		if err = json.Unmarshal(message, &input); err != nil {
+			os.Exit(1)
+		}
+	}
+
+	if input.Request.Stream {
+		input.Request.Stream = false
+		input.Request.Body = string(rest)
+
+		// The JSON strings must be valid UTF-8.
+		if !binaryEncoded && !utf8.Valid(rest) {
+			input.Request.Body = base64.StdEncoding.EncodeToString(rest)
+			input.Request.BodyEncoding = "base64"
+		}
+	}
+
+	output := input
+	output.Context = ""
+	output.Version = 0
+
+	switch input.Context {
+	case "handshake":
+		output = message{Version: 2}
+	case "request":
+		handleRequest(&output)
+	}
+
+	if binaryEncoded {
+		_, _ = os.Stdout.Write(encode(output))
+
+		return
+	}
+
+	_ = json.NewEncoder(os.Stdout).Encode(output)
+}
+
+func handleRequest(output *message) {
+	headers := output.Request.Headers
+
+	output.Response = response{
+		Headers: http.Header{
+			"X-Conformance-Url": {output.Request.URL},
+			"Set-Cookie":        {"a=1", "b=2"},
+		},
+		Body:         output.Request.Body,
+		BodyEncoding: output.Request.BodyEncoding,
+	}
+
+	if status, err := strconv.Atoi(headers.Get("X-Conformance-Status")); err == nil {
+		output.Response.Status = status
+	}
+
+	if location := headers.Get("X-Conformance-Location"); location != "" {
+		output.Response.Headers.Set("Location", location)
+	}
+
+	if rewrite := headers.Get("X-Conformance-Rewrite"); rewrite != "" {
+		output.Request.URL = rewrite
+	}
+
+	output.Action = headers.Get("X-Conformance-Action")
+}
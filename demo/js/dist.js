@@ -19,20 +19,226 @@
       context.bufferOffset += chunk.length;
       return context;
     }, { bufferOffset: 0, finalBuffer: new Uint8Array(totalBytes) });
-    const maybeJson = new TextDecoder().decode(finalBuffer);
+    if (isBinary(finalBuffer)) {
+      return { binary: true, input: decodeBinary(finalBuffer) };
+    }
+    const newline = finalBuffer.indexOf(10);
+    const message = newline === -1 ? finalBuffer : finalBuffer.subarray(0, newline);
+    const maybeJson = new TextDecoder().decode(message);
     try {
-      return JSON.parse(maybeJson);
+      const input = JSON.parse(maybeJson);
+      if (input.request?.stream) {
+        Object.assign(input.request, decodeBody(finalBuffer.subarray(newline + 1)));
+      }
+      return { binary: false, input };
     } catch {
-      return {};
+      return { binary: false, input: {} };
     }
   }
-  function writeOutput(output) {
-    const encodedOutput = new TextEncoder().encode(JSON.stringify(output));
-    const buffer = new Uint8Array(encodedOutput);
+  function writeOutput(output, binary) {
+    const { chunks, ...response } = output.response ?? {};
+    const message = output.response ? { ...output, response } : output;
+    const buffer = binary ? encodeBinary(message) : new TextEncoder().encode(JSON.stringify(message) + "\n");
+    writeStdout(buffer);
+    for (const chunk of chunks ?? []) {
+      writeStdout(typeof chunk === "string" ? new TextEncoder().encode(chunk) : chunk);
+    }
+  }
+  function writeStdout(buffer) {
     const fd = 1;
     Javy.IO.writeSync(fd, buffer);
   }
+  var MAGIC = [87, 90, 66, 49];
+  var ABSENT = 4294967295;
+  var BASE64 = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/";
+  function isBinary(buffer) {
+    return buffer.length >= MAGIC.length && MAGIC.every((byte, i) => buffer[i] === byte);
+  }
+  function toBase64(bytes) {
+    let output = "";
+    for (let i = 0; i < bytes.length; i += 3) {
+      const chunk = (bytes[i] ?? 0) << 16 | (bytes[i + 1] ?? 0) << 8 | (bytes[i + 2] ?? 0);
+      output += BASE64.charAt(chunk >> 18 & 63) + BASE64.charAt(chunk >> 12 & 63);
+      output += i + 1 < bytes.length ? BASE64.charAt(chunk >> 6 & 63) : "=";
+      output += i + 2 < bytes.length ? BASE64.charAt(chunk & 63) : "=";
+    }
+    return output;
+  }
+  function fromBase64(value) {
+    const clean = value.replace(/=+$/, "");
+    const bytes = new Uint8Array(Math.floor(clean.length * 3 / 4));
+    let buffer = 0;
+    let bits = 0;
+    let offset = 0;
+    for (const char of clean) {
+      buffer = buffer << 6 | BASE64.indexOf(char);
+      bits += 6;
+      if (bits >= 8) {
+        bits -= 8;
+        bytes[offset++] = buffer >> bits & 255;
+      }
+    }
+    return bytes;
+  }
+  var BinaryReader = class {
+    buffer;
+    offset = MAGIC.length;
+    view;
+    constructor(buffer) {
+      this.buffer = buffer;
+      this.view = new DataView(buffer.buffer, buffer.byteOffset, buffer.byteLength);
+    }
+    uint32() {
+      const value = this.view.getUint32(this.offset);
+      this.offset += 4;
+      return value;
+    }
+    bytes() {
+      const length = this.uint32();
+      if (length === ABSENT) {
+        return null;
+      }
+      const value = this.buffer.subarray(this.offset, this.offset + length);
+      this.offset += length;
+      return value;
+    }
+    string() {
+      const value = this.bytes();
+      return value ? new TextDecoder().decode(value) : "";
+    }
+    headers() {
+      const headers = {};
+      const count = this.uint32();
+      if (count === ABSENT) {
+        return headers;
+      }
+      for (let i = 0; i < count; i++) {
+        const key = this.string();
+        const length = this.uint32();
+        const values = [];
+        for (let j = 0; length !== ABSENT && j < length; j++) {
+          values.push(this.string());
+        }
+        headers[key] = values;
+      }
+      return headers;
+    }
+    body() {
+      return decodeBody(this.bytes() ?? new Uint8Array());
+    }
+    // The bytes following the message
+    rest() {
+      return this.buffer.subarray(this.offset);
+    }
+  };
+  function decodeBody(bytes) {
+    try {
+      return { body: new TextDecoder("utf-8", { fatal: true }).decode(bytes) };
+    } catch {
+      return { body: toBase64(bytes), bodyEncoding: "base64" };
+    }
+  }
+  function decodeBinary(buffer) {
+    const reader = new BinaryReader(buffer);
+    const context = reader.string();
+    const version = reader.uint32();
+    const error = reader.string();
+    const action = reader.string();
+    const method = reader.string();
+    const url = reader.string();
+    const headers = reader.headers();
+    const body = reader.bytes();
+    const response = {
+      status: reader.uint32(),
+      headers: reader.headers(),
+      trailers: reader.headers(),
+      ...reader.body()
+    };
+    const request = {
+      method,
+      url,
+      headers,
+      ...decodeBody(body ?? reader.rest()),
+      ...body === null ? { stream: true } : {}
+    };
+    return {
+      context,
+      version,
+      error,
+      ...action ? { action } : {},
+      request,
+      response
+    };
+  }
+  var BinaryWriter = class {
+    chunks = [new Uint8Array(MAGIC)];
+    uint32(value) {
+      const chunk = new Uint8Array(4);
+      new DataView(chunk.buffer).setUint32(0, value);
+      this.chunks.push(chunk);
+    }
+    bytes(value) {
+      this.uint32(value.length);
+      this.chunks.push(value);
+    }
+    string(value) {
+      this.bytes(new TextEncoder().encode(value ?? ""));
+    }
+    headers(headers) {
+      if (!headers) {
+        this.uint32(ABSENT);
+        return;
+      }
+      const keys = Object.keys(headers);
+      this.uint32(keys.length);
+      for (const key of keys) {
+        this.string(key);
+        const values = headers[key];
+        if (!values) {
+          this.uint32(ABSENT);
+          continue;
+        }
+        this.uint32(values.length);
+        values.forEach((value) => this.string(value));
+      }
+    }
+    body(body, bodyEncoding) {
+      if (body === null || body === void 0) {
+        this.uint32(ABSENT);
+        return;
+      }
+      this.bytes(bodyEncoding === "base64" ? fromBase64(body) : new TextEncoder().encode(body));
+    }
+    concat() {
+      const length = this.chunks.reduce((total, chunk) => total + chunk.length, 0);
+      const buffer = new Uint8Array(length);
+      let offset = 0;
+      for (const chunk of this.chunks) {
+        buffer.set(chunk, offset);
+        offset += chunk.length;
+      }
+      return buffer;
+    }
+  };
+  function encodeBinary(output) {
+    const writer = new BinaryWriter();
+    writer.string("");
+    writer.uint32(output.version ?? 0);
+    writer.string(output.error ?? "");
+    writer.string(output.action ?? "");
+    writer.string(output.request?.method);
+    writer.string(output.request?.url);
+    writer.headers(output.request?.headers);
+    writer.body(output.request?.body, output.request?.bodyEncoding);
+    writer.uint32(output.response?.status ?? 0);
+    writer.headers(output.response?.headers);
+    writer.headers(output.response?.trailers);
+    writer.body(output.response?.body, output.response?.bodyEncoding);
+    return writer.concat();
+  }
+  var PROTOCOL_VERSION = 2;
   function handleWasm(handleRequest2, handleResponse2) {
+    const { binary, input: received } = readInput();
     const input = {
       context: null,
       response: {
@@ -41,7 +247,7 @@
       },
       request: {},
       error: null,
-      ...readInput()
+      ...received
     };
     let output = {
       request: {
@@ -58,6 +264,9 @@
       error: ""
     };
     switch (input.context) {
+      case "handshake":
+        output = { ...output, version: PROTOCOL_VERSION };
+        break;
       case "request":
         output = handleRequest2(input);
         break;
@@ -65,7 +274,7 @@
         output = handleResponse2(input);
         break;
     }
-    writeOutput(output);
+    writeOutput(output, binary);
   }
 
   // handler.js
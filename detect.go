@@ -0,0 +1,102 @@
+package wazemmes
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// AutoBuilder detects the builder from the module imports and exports.
+const AutoBuilder = "auto"
+
+const (
+	httpHandlerModule   = "http_handler"
+	javyProviderPrefix  = "javy_quickjs_provider"
+	wasiPreview1Module  = "wasi_snapshot_preview1"
+	httpHandleRequestFn = "handle_request"
+)
+
+var wasmMagic = []byte("\x00asm")
+
+func init() {
+	RegisterBuilder(AutoBuilder, func(o BuilderOptions) (*WasmHandler, error) {
+		var builder, reason string
+
+		switch {
+		case o.DocumentRoot != "":
+			builder, reason = "php", "a document root is configured"
+		case len(o.Routes) > 0:
+			builder, reason = "cgi", "routes are configured"
+		default:
+			var err error
+
+			builder, reason, err = detectBuilder(o.Source)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		name := "routes"
+		if o.Source != nil {
+			name = o.Source.Name()
+		}
+
+		o.Logger.Sugar().Infof("module %s uses the %s builder: %s", name, builder, reason)
+
+		factory, err := lookupBuilder(builder)
+		if err != nil {
+			return nil, err
+		}
+
+		return factory(o)
+	})
+}
+
+// detectBuilder returns the builder name matching the module and the reason
+// of this choice. The module sections are read as is, the module is compiled
+// by the builder only.
+func detectBuilder(source ModuleSource) (string, string, error) {
+	if source == nil {
+		return "", "", errors.New("impossible to detect the builder: no module, document root or route is configured")
+	}
+
+	code, err := source.Bytes()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read WASM module: %w", err)
+	}
+
+	if !bytes.HasPrefix(code, wasmMagic) {
+		if strings.EqualFold(filepath.Ext(source.Name()), ".php") {
+			return "php", "the source is a PHP script", nil
+		}
+
+		return "", "", fmt.Errorf("impossible to detect the builder of %s: not a WASM module", source.Name())
+	}
+
+	module, err := inspectModule(code)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read the WASM module %s: %w", source.Name(), err)
+	}
+
+	switch {
+	case module.imports[httpHandlerModule]:
+		return "go", "the module imports " + httpHandlerModule, nil
+	case module.exportsFunction(httpHandleRequestFn):
+		return "go", "the module exports " + httpHandleRequestFn, nil
+	}
+
+	for name := range module.imports {
+		if strings.HasPrefix(name, javyProviderPrefix) {
+			return "js", "the module imports " + name, nil
+		}
+	}
+
+	delete(module.imports, wasiPreview1Module)
+	if module.exportsFunction("_start") && len(module.imports) == 0 {
+		return "js", "the module is a WASI command, using the stdio JSON protocol", nil
+	}
+
+	return "", "", fmt.Errorf("impossible to detect the builder of %s from its imports and exports", source.Name())
+}
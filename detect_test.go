@@ -0,0 +1,109 @@
+package wazemmes
+
+import (
+	"strings"
+	"testing"
+)
+
+// wasmName encodes a name of the import and export sections.
+func wasmName(name string) string {
+	return string(rune(len(name))) + name
+}
+
+// wasmModule returns a module made of the given sections, each section being
+// its id followed by its content.
+func wasmModule(sections ...string) []byte {
+	code := "\x00asm\x01\x00\x00\x00"
+	for _, section := range sections {
+		code += section[:1] + string(rune(len(section)-1)) + section[1:]
+	}
+
+	return []byte(code)
+}
+
+func TestDetectBuilder(t *testing.T) {
+	wasiImport := wasmName(wasiPreview1Module) + wasmName("fd_write") + "\x00\x00"
+	start := wasmName("_start") + "\x00\x00"
+
+	for _, tc := range []struct {
+		name    string
+		source  ModuleSource
+		builder string
+		err     string
+	}{
+		{name: "no source", err: "no module"},
+		{name: "php script", source: NewBytesSource("index.php", []byte("<?php echo 1;")), builder: "php"},
+		{name: "not wasm", source: NewBytesSource("main.js", []byte("console.log(1)")), err: "not a WASM module"},
+		{
+			name:    "http handler import",
+			source:  NewBytesSource("guest.wasm", wasmModule("\x02\x01"+wasmName(httpHandlerModule)+wasmName("get_uri")+"\x00\x00")),
+			builder: "go",
+		},
+		{
+			name:    "handle_request export",
+			source:  NewBytesSource("guest.wasm", wasmModule("\x07\x01"+wasmName(httpHandleRequestFn)+"\x00\x00")),
+			builder: "go",
+		},
+		{
+			name: "javy provider memory import",
+			source: NewBytesSource("guest.wasm", wasmModule(
+				"\x02\x01"+wasmName(javyProviderPrefix+"_v3")+wasmName("memory")+"\x02\x01\x01\x10",
+			)),
+			builder: "js",
+		},
+		{
+			name:    "wasi command",
+			source:  NewBytesSource("guest.wasm", wasmModule("\x02\x01"+wasiImport, "\x07\x01"+start)),
+			builder: "js",
+		},
+		{
+			name:   "global export is not a function",
+			source: NewBytesSource("guest.wasm", wasmModule("\x07\x01"+wasmName(httpHandleRequestFn)+"\x03\x00")),
+			err:    "from its imports and exports",
+		},
+		{
+			name:   "unknown import",
+			source: NewBytesSource("guest.wasm", wasmModule("\x02\x01"+wasmName("env")+wasmName("f")+"\x00\x00", "\x07\x01"+start)),
+			err:    "from its imports and exports",
+		},
+		{
+			name:   "truncated section",
+			source: NewBytesSource("guest.wasm", wasmModule("\x07\x01" + start)[:12]),
+			err:    "exceeds the module",
+		},
+		{
+			name:   "hostile name length",
+			source: NewBytesSource("guest.wasm", wasmModule("\x07\x01\xff\xff\xff\xff\x0f")),
+			err:    "invalid name length",
+		},
+		{
+			name:   "unknown import kind",
+			source: NewBytesSource("guest.wasm", wasmModule("\x02\x01"+wasmName("env")+wasmName("f")+"\x09\x00")),
+			err:    "unknown import kind",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			builder, _, err := detectBuilder(tc.source)
+
+			switch {
+			case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+				t.Errorf("got the error %v, expected %q", err, tc.err)
+			case tc.err == "" && err != nil:
+				t.Errorf("got the error %v", err)
+			case builder != tc.builder:
+				t.Errorf("got the builder %q, expected %q", builder, tc.builder)
+			}
+		})
+	}
+}
+
+func TestDetectBuilderGuest(t *testing.T) {
+	builder, reason, err := detectBuilder(buildGuest(t, "cgi"))
+	if err != nil {
+		t.Fatalf("got the error %v", err)
+	}
+
+	if builder != "js" {
+		t.Errorf("got the builder %q (%s), expected js", builder, reason)
+	}
+}
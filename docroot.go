@@ -0,0 +1,144 @@
+package wazemmes
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultIndexFiles are the scripts run for a directory of the document root.
+var DefaultIndexFiles = []string{"index.php"}
+
+// docRoot resolves the request paths to the scripts of a document root, the
+// way the web servers do for their CGI scripts.
+type docRoot struct {
+	// dir is the absolute path of the document root on the host, it is
+	// mounted at the same path in the guest.
+	dir        string
+	fsys       fs.FS
+	ext        string
+	indexFiles []string
+	// frontController runs for the paths matching no file, when set.
+	frontController string
+}
+
+// script is a resolved script, its name is its path in the URL space and
+// its filename its path in the guest.
+type script struct {
+	name     string
+	filename string
+	pathInfo string
+}
+
+func newDocRoot(dir, ext string, indexFiles []string, frontController string) (*docRoot, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, fmt.Errorf("invalid document root %s: %w", dir, err)
+	}
+
+	if len(indexFiles) == 0 {
+		indexFiles = DefaultIndexFiles
+	}
+
+	d := &docRoot{
+		dir:        abs,
+		fsys:       os.DirFS(abs),
+		ext:        ext,
+		indexFiles: indexFiles,
+	}
+
+	if !d.isDir("/") {
+		return nil, fmt.Errorf("the document root %s is not a directory", dir)
+	}
+
+	if frontController != "" {
+		d.frontController = path.Clean("/" + frontController)
+
+		if !d.isFile(d.frontController) {
+			return nil, fmt.Errorf("the front controller %s is not a file of the document root", frontController)
+		}
+	}
+
+	return d, nil
+}
+
+// guestDir is the document root in the guest.
+func (d *docRoot) guestDir() string {
+	return filepath.ToSlash(d.dir)
+}
+
+// resolve returns the script of the URL path. The first segment with the
+// script extension is the script and the rest is its PATH_INFO, a directory
+// runs its index file. The paths matching no file run the front controller.
+// It returns false for the static files and the missing ones.
+func (d *docRoot) resolve(urlPath string) (script, bool) {
+	clean := path.Clean("/" + urlPath)
+
+	for i := 0; i < len(clean); {
+		j := strings.Index(strings.ToLower(clean[i:]), d.ext)
+		if j < 0 {
+			break
+		}
+
+		end := i + j + len(d.ext)
+		if (end == len(clean) || clean[end] == '/') && d.isFile(clean[:end]) {
+			return d.script(clean[:end], clean[end:]), true
+		}
+
+		i = end
+	}
+
+	if d.isDir(clean) {
+		for _, index := range d.indexFiles {
+			if name := path.Join(clean, index); d.isFile(name) {
+				return d.script(name, ""), true
+			}
+		}
+
+		return script{}, false
+	}
+
+	if d.frontController != "" && !d.exists(clean) {
+		return d.script(d.frontController, ""), true
+	}
+
+	return script{}, false
+}
+
+func (d *docRoot) script(name, pathInfo string) script {
+	return script{
+		name:     name,
+		filename: path.Join(d.guestDir(), name),
+		pathInfo: pathInfo,
+	}
+}
+
+func (d *docRoot) stat(name string) (fs.FileInfo, error) {
+	name = strings.TrimPrefix(name, "/")
+	if name == "" {
+		name = "."
+	}
+
+	return fs.Stat(d.fsys, name)
+}
+
+func (d *docRoot) exists(name string) bool {
+	_, err := d.stat(name)
+
+	return err == nil
+}
+
+func (d *docRoot) isFile(name string) bool {
+	info, err := d.stat(name)
+
+	return err == nil && info.Mode().IsRegular()
+}
+
+func (d *docRoot) isDir(name string) bool {
+	info, err := d.stat(name)
+
+	return err == nil && info.IsDir()
+}
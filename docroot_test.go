@@ -0,0 +1,128 @@
+package wazemmes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+// newTestDocRoot creates a document root holding the files.
+func newTestDocRoot(t *testing.T, frontController string, indexFiles []string, files ...string) *docRoot {
+	t.Helper()
+
+	dir := t.TempDir()
+	for _, name := range files {
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(file, nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d, err := newDocRoot(dir, ".php", indexFiles, frontController)
+	if err != nil {
+		t.Fatalf("impossible to create the document root: %v", err)
+	}
+
+	return d
+}
+
+func TestDocRootResolve(t *testing.T) {
+	files := []string{"index.php", "info.php", "style.css", "app/index.php", "app/api.php", "static/logo.png", "a.php.d/b.php", "UPPER.PHP"}
+
+	for _, tc := range []struct {
+		name            string
+		frontController string
+		indexFiles      []string
+		path            string
+		script          string
+		pathInfo        string
+		ok              bool
+	}{
+		{name: "script", path: "/info.php", script: "/info.php", ok: true},
+		{name: "root index", path: "/", script: "/index.php", ok: true},
+		{name: "directory index", path: "/app/", script: "/app/index.php", ok: true},
+		{name: "directory without slash", path: "/app", script: "/app/index.php", ok: true},
+		{name: "path info", path: "/info.php/a/b", script: "/info.php", pathInfo: "/a/b", ok: true},
+		{name: "nested path info", path: "/app/api.php/users/1", script: "/app/api.php", pathInfo: "/users/1", ok: true},
+		{name: "extension inside a segment", path: "/info.phpx", ok: false},
+		{name: "extension in a directory", path: "/a.php.d/b.php/x", script: "/a.php.d/b.php", pathInfo: "/x", ok: true},
+		{name: "case insensitive extension", path: "/UPPER.PHP", script: "/UPPER.PHP", ok: true},
+		{name: "static file", path: "/style.css", ok: false},
+		{name: "missing file", path: "/missing.php", ok: false},
+		{name: "directory without index", path: "/static/", ok: false},
+		{name: "traversal", path: "/../../etc/passwd.php", ok: false},
+		{name: "traversal to a script", path: "/static/../../info.php", script: "/info.php", ok: true},
+		{name: "dot segments", path: "/app/./../app/api.php", script: "/app/api.php", ok: true},
+		{name: "custom index", indexFiles: []string{"api.php", "index.php"}, path: "/app/", script: "/app/api.php", ok: true},
+		{name: "front controller", frontController: "index.php", path: "/blog/post", script: "/index.php", ok: true},
+		{name: "front controller keeps the static files", frontController: "index.php", path: "/style.css", ok: false},
+		{name: "front controller keeps the directories", frontController: "index.php", path: "/static/", ok: false},
+		{name: "front controller for the missing scripts", frontController: "/app/index.php", path: "/missing.php", script: "/app/index.php", ok: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d := newTestDocRoot(t, tc.frontController, tc.indexFiles, files...)
+
+			target, ok := d.resolve(tc.path)
+			if ok != tc.ok || target.name != tc.script || target.pathInfo != tc.pathInfo {
+				t.Fatalf("got the script %q with the path info %q (%t), expected %q with %q (%t)", target.name, target.pathInfo, ok, tc.script, tc.pathInfo, tc.ok)
+			}
+
+			if ok && target.filename != d.guestDir()+tc.script {
+				t.Errorf("got the filename %q", target.filename)
+			}
+		})
+	}
+}
+
+func TestNewDocRoot(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "index.php"), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := newDocRoot(filepath.Join(dir, "index.php"), ".php", nil, ""); err == nil {
+		t.Error("a file is accepted as document root")
+	}
+
+	if _, err := newDocRoot(dir, ".php", nil, "missing.php"); err == nil {
+		t.Error("a missing front controller is accepted")
+	}
+
+	d, err := newDocRoot(dir, ".php", nil, "")
+	if err != nil {
+		t.Fatalf("got the error %v", err)
+	}
+
+	if len(d.indexFiles) != 1 || d.indexFiles[0] != DefaultIndexFiles[0] {
+		t.Errorf("got the index files %v, expected %v", d.indexFiles, DefaultIndexFiles)
+	}
+}
+
+func TestDocumentRootWithoutSource(t *testing.T) {
+	d := newTestDocRoot(t, "", nil, "index.php")
+
+	rec, err := serveGuest(t, "", BuilderOptions{
+		DocumentRoot: d.dir,
+		Interpreter:  buildGuest(t, "cgi"),
+	}, httptest.NewRequest(http.MethodGet, "/", nil))
+	if err != nil {
+		t.Fatalf("got the error %v", err)
+	}
+
+	if expected := "SCRIPT_FILENAME=" + d.guestDir() + "/index.php\n"; !strings.Contains(rec.Body.String(), expected) {
+		t.Errorf("got the body %q, expected it to contain %q", rec.Body.String(), expected)
+	}
+
+	if _, err = NewWasmHandlerWithOptions("php", BuilderOptions{Logger: zap.NewNop()}); err == nil {
+		t.Error("the php builder is built without script nor document root")
+	}
+}
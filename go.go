@@ -52,6 +52,23 @@ func hostInstanciation(ctx context.Context, runtime wazero.Runtime, mod wazero.C
 	}, nil
 }
 
+// goInstance owns an http-wasm middleware, and then its own guest instance.
+type goInstance struct {
+	mw wasm.Middleware
+}
+
+func (g *goInstance) NewHandler(ctx context.Context, next Handler) Handler {
+	return HandlerFunc(func(rw http.ResponseWriter, req *http.Request) error {
+		g.mw.NewHandler(ctx, wazemmesToHTTPHandler(next)).ServeHTTP(rw, req)
+
+		return nil
+	})
+}
+
+func (g *goInstance) Close(ctx context.Context) error {
+	return g.mw.Close(ctx)
+}
+
 func wazemmesToHTTPHandler(handler Handler) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
 		_ = handler.ServeHTTP(rw, req)
@@ -59,11 +76,35 @@ func wazemmesToHTTPHandler(handler Handler) http.Handler {
 }
 
 func NewWasmHandlerGo(modulepath string, moduleConfig any, poolConfiguration map[string]interface{}, logger *zap.Logger) (*WasmHandler, error) {
-	cache := wazero.NewCompilationCache()
+	return NewWasmHandlerGoFromSource(NewFileSource(modulepath), moduleConfig, poolConfiguration, logger)
+}
+
+func NewWasmHandlerGoFromSource(source ModuleSource, moduleConfig any, poolConfiguration map[string]interface{}, logger *zap.Logger) (*WasmHandler, error) {
+	return newWasmHandlerGo(BuilderOptions{
+		Source:        source,
+		Configuration: moduleConfig,
+		Pool:          poolConfiguration,
+		Logger:        logger,
+	})
+}
+
+func newWasmHandlerGo(o BuilderOptions) (_ *WasmHandler, err error) {
+	logger := o.Logger
 	ctx := context.Background()
 
-	wa0Rt := host.NewRuntime(wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().WithCompilationCache(cache).WithCloseOnContextDone(true)))
-	code, err := os.ReadFile(modulepath)
+	runtimeConfig, err := newRuntimeConfig(o)
+	if err != nil {
+		return nil, err
+	}
+
+	wa0Rt := host.NewRuntime(wazero.NewRuntimeWithConfig(ctx, runtimeConfig))
+	defer func() {
+		if err != nil {
+			_ = wa0Rt.Close(ctx)
+		}
+	}()
+
+	code, err := o.Source.Bytes()
 	if err != nil {
 		logger.Sugar().Infof("impossible to read the custom module: %v", err)
 		return nil, err
@@ -85,9 +126,14 @@ func NewWasmHandlerGo(modulepath string, moduleConfig any, poolConfiguration map
 	opts := []handler.Option{
 		handler.ModuleConfig(config),
 		handler.Logger(NewLogger(logger.Sugar())),
+		// Each pooled instance owns its runtime, the shared compilation cache
+		// avoids compiling the module again.
+		handler.Runtime(func(ctx context.Context) (wazero.Runtime, error) {
+			return wazero.NewRuntimeWithConfig(ctx, runtimeConfig), nil
+		}),
 	}
 
-	data, err := json.Marshal(moduleConfig)
+	data, err := json.Marshal(o.Configuration)
 	if err != nil {
 		logger.Sugar().Infof("marshaling config: %v", err)
 		return nil, err
@@ -95,17 +141,20 @@ func NewWasmHandlerGo(modulepath string, moduleConfig any, poolConfiguration map
 
 	opts = append(opts, handler.GuestConfig(data))
 
-	mw, err := wasm.NewMiddleware(applyCtx(ctx), code, opts...)
+	w, err := newWasmHandler(withMemoryBudget(o.memoryBudget(), func(ctx context.Context) (instance, error) {
+		mw, err := wasm.NewMiddleware(applyCtx(ctx), code, opts...)
+		if err != nil {
+			logger.Sugar().Infof("creating middleware: %v", err)
+			return nil, err
+		}
+
+		return &goInstance{mw: mw}, nil
+	}, memoryReservation(o, customModule)), o.Pool, logger)
 	if err != nil {
-		logger.Sugar().Infof("creating middleware: %v", err)
 		return nil, err
 	}
 
-	return NewWasmHandlerInstance(func(ctx context.Context, next Handler) Handler {
-		return HandlerFunc(func(rw http.ResponseWriter, req *http.Request) error {
-			mw.NewHandler(ctx, wazemmesToHTTPHandler(next)).ServeHTTP(rw, req)
+	w.onClose(wa0Rt.Close)
 
-			return nil
-		})
-	}, poolConfiguration, logger)
+	return w, nil
 }
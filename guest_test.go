@@ -0,0 +1,55 @@
+package wazemmes
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+var (
+	guestsMu  sync.Mutex
+	guestsDir string
+)
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "wazemmes-guests-*")
+	if err != nil {
+		panic(err)
+	}
+
+	guestsDir = dir
+	code := m.Run()
+
+	_ = os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// buildGuest builds the command of the testdata directory for wasip1 once per
+// run, the test is skipped without a go command.
+func buildGuest(t *testing.T, name string) ModuleSource {
+	t.Helper()
+
+	guestsMu.Lock()
+	defer guestsMu.Unlock()
+
+	output := filepath.Join(guestsDir, name+".wasm")
+	if _, err := os.Stat(output); err == nil {
+		return NewFileSource(output)
+	}
+
+	goBin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("the go command is needed to build the test guests")
+	}
+
+	cmd := exec.Command(goBin, "build", "-o", output, "./testdata/"+name)
+	cmd.Env = append(os.Environ(), "GOOS=wasip1", "GOARCH=wasm")
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("impossible to build the %s guest: %v\n%s", name, err, out)
+	}
+
+	return NewFileSource(output)
+}
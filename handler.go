@@ -4,8 +4,10 @@ import (
 	"context"
 	"errors"
 	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	pool "github.com/jolestar/go-commons-pool/v2"
 	"go.uber.org/zap"
 )
 
@@ -21,64 +23,185 @@ type Handler interface {
 type WasmMiddleware func(http.ResponseWriter, *http.Request, http.Handler) error
 type WasmHandler struct {
 	Configuration configuration
-	pool          *pool.ObjectPool
-	logger        *zap.Logger
+	// generation is swapped atomically when the module is hot-reloaded, the
+	// in-flight requests keep the generation they borrowed from.
+	generation atomic.Pointer[generation]
+	logger     *zap.Logger
+	done       chan struct{}
+	closeOnce  sync.Once
+	// timeout aborts the guest when it runs for too long, the client then
+	// receives the timeoutStatus.
+	timeout       time.Duration
+	timeoutStatus int
+	// script is the source run by an interpreter, it is read by the guest on
+	// each request and not watched for the hot reload.
+	script ModuleSource
+	// shared are the shared sources retained until the handler is closed.
+	shared []sharedSource
 }
 
+// NewWasmHandlerInstance pools a stateless handler, the builders pool their
+// own guest instances.
 func NewWasmHandlerInstance(handler func(ctx context.Context, next Handler) Handler, poolConfiguration map[string]interface{}, logger *zap.Logger) (*WasmHandler, error) {
-	return &WasmHandler{
-		pool:   newPoolConfiguration(handler, poolConfiguration),
-		logger: logger,
-	}, nil
+	return newWasmHandler(func(context.Context) (instance, error) {
+		return &funcInstance{handler: handler}, nil
+	}, poolConfiguration, logger)
+}
+
+func newWasmHandler(newInstance func(context.Context) (instance, error), poolConfiguration map[string]interface{}, logger *zap.Logger) (*WasmHandler, error) {
+	objectPool, err := newPoolConfiguration(newInstance, poolConfiguration)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &WasmHandler{
+		logger:        logger,
+		done:          make(chan struct{}),
+		timeoutStatus: defaultTimeoutStatus,
+	}
+	w.generation.Store(&generation{pool: objectPool})
+
+	return w, nil
 }
 
 func NewWasmHandler(modulepath, builder string, moduleConfig any, poolConfiguration map[string]interface{}, logger *zap.Logger) (*WasmHandler, error) {
-	switch builder {
-	case "js", "javascript", "asc", "assemblyscript":
-		return NewWasmHandlerJS(modulepath, moduleConfig, poolConfiguration, logger)
-	case "php":
-		return NewWasmHandlerPHP(modulepath, moduleConfig, poolConfiguration, logger)
+	return NewWasmHandlerFromSource(NewFileSource(modulepath), builder, moduleConfig, poolConfiguration, logger)
+}
+
+// NewWasmHandlerFromSource builds the handler from any module source using
+// a registered builder, the DefaultBuilder is used when builder is empty. The
+// PHP builder runs the embedded interpreter and uses the source name as the
+// script path.
+func NewWasmHandlerFromSource(source ModuleSource, builder string, moduleConfig any, poolConfiguration map[string]interface{}, logger *zap.Logger) (*WasmHandler, error) {
+	return NewWasmHandlerWithOptions(builder, BuilderOptions{
+		Source:        source,
+		Configuration: moduleConfig,
+		Pool:          poolConfiguration,
+		Logger:        logger,
+	})
+}
+
+// NewWasmHandlerWithOptions builds the handler using the registered builder.
+func NewWasmHandlerWithOptions(builder string, options BuilderOptions) (*WasmHandler, error) {
+	factory, err := lookupBuilder(builder)
+	if err != nil {
+		return nil, err
+	}
+
+	build := func() (*WasmHandler, error) {
+		return factory(options)
+	}
+
+	shared := retainSources(options.sources())
+
+	w, err := build()
+	if err != nil {
+		for _, source := range shared {
+			source.release()
+		}
+
+		return nil, err
+	}
+
+	w.shared = shared
+	w.timeout = options.Timeout
+	if options.TimeoutStatus != 0 {
+		w.timeoutStatus = options.TimeoutStatus
+	}
+
+	if !options.DisableReload {
+		w.watch(options.sources(), build)
 	}
 
-	return NewWasmHandlerGo(modulepath, moduleConfig, poolConfiguration, logger)
+	return w, nil
 }
 
 func (w *WasmHandler) ServeHTTP(rw http.ResponseWriter, rq *http.Request, next Handler) error {
-	value, err := w.pool.BorrowObject(rq.Context())
-	defer func() {
-		_ = w.pool.ReturnObject(rq.Context(), value)
-	}()
+	gen, err := w.acquire()
 	if err != nil {
 		return err
 	}
 
-	handler, ok := value.(func(ctx context.Context, next Handler) Handler)
+	defer gen.leave()
+
+	objectPool := gen.pool
+
+	value, err := objectPool.BorrowObject(rq.Context())
+	if err != nil {
+		return err
+	}
+
+	guest, ok := value.(instance)
 	if !ok {
-		return errors.New("impossible to cast the borrowed object into a WASM HTTP handler")
+		_ = objectPool.ReturnObject(rq.Context(), value)
+
+		return errors.New("impossible to cast the borrowed object into a WASM instance")
+	}
+
+	// The guest runs with its own context to be aborted on timeout, the
+	// downstream handlers keep the request one. The instances call the next
+	// handler themselves.
+	ctx, timer, cancel := withGuestTimeout(rq.Context(), w.timeout)
+	defer cancel()
+
+	guestNext := next
+	if next != nil {
+		guestNext = HandlerFunc(func(rw http.ResponseWriter, req *http.Request) error {
+			timer.pause()
+			defer timer.resume()
+
+			return next.ServeHTTP(rw, req.WithContext(rq.Context()))
+		})
 	}
 
-	result := handler(rq.Context(), next)
+	tracked := &startedWriter{ResponseWriter: rw}
+
+	result := guest.NewHandler(ctx, guestNext)
 	if result != nil {
-		err = result.ServeHTTP(rw, rq)
+		err = result.ServeHTTP(tracked, rq.WithContext(ctx))
 	}
 
-	if err != nil {
-		return err
+	if abortErr := guestAbortError(ctx); abortErr != nil {
+		// The aborted instance is closed, it can't go back to the pool.
+		_ = objectPool.InvalidateObject(context.Background(), value)
+
+		return w.abort(tracked, abortErr)
 	}
 
-	if next != nil {
-		return next.ServeHTTP(rw, rq)
+	_ = objectPool.ReturnObject(rq.Context(), value)
+
+	return err
+}
+
+// abort answers with the timeout status, unless the response already
+// started.
+func (w *WasmHandler) abort(rw *startedWriter, abortErr error) error {
+	if errors.Is(abortErr, ErrGuestTimeout) {
+		w.logger.Sugar().Errorf("the WASM guest exceeded its %s timeout", w.timeout)
+
+		if !rw.started {
+			rw.WriteHeader(w.timeoutStatus)
+			_, _ = rw.Write([]byte(http.StatusText(w.timeoutStatus)))
+		}
+	} else {
+		w.logger.Sugar().Warnf("the WASM guest was aborted: %v", abortErr)
 	}
 
-	return nil
+	return abortErr
 }
 
 func BuildMiddlewareChain(logger *zap.Logger, chain []*WasmHandler) Handler {
+	return BuildMiddlewareChainWithNext(logger, chain, nil)
+}
+
+// BuildMiddlewareChainWithNext builds the chain ending with the next handler,
+// so the guests handling the response receive the downstream one.
+func BuildMiddlewareChainWithNext(logger *zap.Logger, chain []*WasmHandler, next Handler) Handler {
 	if len(chain) > 0 {
 		nextMw := chain[0]
 
 		return HandlerFunc(func(rw http.ResponseWriter, req *http.Request) error {
-			err := nextMw.ServeHTTP(rw, req, BuildMiddlewareChain(logger, chain[1:]))
+			err := nextMw.ServeHTTP(rw, req, BuildMiddlewareChainWithNext(logger, chain[1:], next))
 
 			if err != nil {
 				logger.Sugar().Errorf("error in WASM middleware: %#v", err)
@@ -89,6 +212,10 @@ func BuildMiddlewareChain(logger *zap.Logger, chain []*WasmHandler) Handler {
 	}
 
 	return HandlerFunc(func(rw http.ResponseWriter, req *http.Request) error {
+		if next != nil {
+			return next.ServeHTTP(rw, req)
+		}
+
 		return nil
 	})
 }
@@ -0,0 +1,127 @@
+package wazemmes
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+var ErrInvalidHeader = errors.New("invalid guest header")
+
+// hopByHopHeaders only make sense for a single connection, a guest can't set
+// them on the response.
+var hopByHopHeaders = map[string]struct{}{
+	"Connection":          {},
+	"Keep-Alive":          {},
+	"Proxy-Authenticate":  {},
+	"Proxy-Authorization": {},
+	"Proxy-Connection":    {},
+	"Te":                  {},
+	"Trailer":             {},
+	"Transfer-Encoding":   {},
+	"Upgrade":             {},
+}
+
+// isToken reports whether the name only contains the token characters of
+// RFC 9110.
+func isToken(name string) bool {
+	if name == "" {
+		return false
+	}
+
+	for _, c := range name {
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' {
+			continue
+		}
+
+		if !strings.ContainsRune("!#$%&'*+-.^_`|~", c) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// invalidHeader tells why a header can't be sent, nil when it can.
+func invalidHeader(key string, values []string) error {
+	if !isToken(key) {
+		return fmt.Errorf("%w: malformed name %q", ErrInvalidHeader, key)
+	}
+
+	if _, ok := hopByHopHeaders[http.CanonicalHeaderKey(key)]; ok {
+		return fmt.Errorf("%w: %s is a hop-by-hop header", ErrInvalidHeader, key)
+	}
+
+	for _, value := range values {
+		if strings.ContainsAny(value, "\r\n\x00") {
+			return fmt.Errorf("%w: malformed value for %s", ErrInvalidHeader, key)
+		}
+	}
+
+	return nil
+}
+
+// dropInvalidHeaders removes and logs the headers that can't be sent, the
+// other ones are still applied.
+func dropInvalidHeaders(logger *zap.Logger, headers http.Header) {
+	for key, values := range headers {
+		if err := invalidHeader(key, values); err != nil {
+			logger.Sugar().Warnf("the guest header was dropped: %v", err)
+			delete(headers, key)
+		}
+	}
+}
+
+// validate checks the status returned by a guest before writing any of the
+// response, its invalid headers and trailers are dropped.
+func (r response) validate(logger *zap.Logger) error {
+	if r.Status != 0 && (r.Status < 200 || r.Status > 599) {
+		return fmt.Errorf("invalid guest status code %d", r.Status)
+	}
+
+	dropInvalidHeaders(logger, r.Headers)
+	dropInvalidHeaders(logger, r.Trailers)
+
+	return nil
+}
+
+// applyHeaders replaces the headers returned by the guest with all their
+// values, a header returned without value is removed. The Content-Length is
+// left to the host as the body may have changed.
+func applyHeaders(dst, headers http.Header) {
+	for key, values := range headers {
+		key = http.CanonicalHeaderKey(key)
+		if key == "Content-Length" {
+			continue
+		}
+
+		dst.Del(key)
+
+		for _, value := range values {
+			dst.Add(key, value)
+		}
+	}
+}
+
+// write sends the status, when set, the body and the trailers. The trailers
+// are announced before the body so the response is chunked.
+func (r response) write(rw http.ResponseWriter, status int) {
+	for key := range r.Trailers {
+		rw.Header().Add("Trailer", http.CanonicalHeaderKey(key))
+	}
+
+	if status != 0 {
+		rw.WriteHeader(status)
+	}
+
+	_, _ = rw.Write([]byte(r.Body))
+
+	for key, values := range r.Trailers {
+		for _, value := range values {
+			rw.Header().Add(http.CanonicalHeaderKey(key), value)
+		}
+	}
+}
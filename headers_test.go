@@ -0,0 +1,68 @@
+package wazemmes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestStopDropsInvalidHeaders(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		response response
+		status   int
+		headers  http.Header
+		err      bool
+	}{
+		{name: "valid", response: response{Headers: http.Header{"X-Guest": {"1"}}}, status: http.StatusOK, headers: http.Header{"X-Guest": {"1"}}},
+		{name: "hop-by-hop", response: response{Headers: http.Header{"Connection": {"close"}, "X-Guest": {"1"}}}, status: http.StatusOK, headers: http.Header{"X-Guest": {"1"}}},
+		{name: "malformed name", response: response{Headers: http.Header{"X Guest": {"1"}, "X-Guest": {"1"}}}, status: http.StatusOK, headers: http.Header{"X-Guest": {"1"}}},
+		{name: "malformed value", response: response{Headers: http.Header{"X-Split": {"1\r\nX-Injected: 1"}, "X-Guest": {"1"}}}, status: http.StatusOK, headers: http.Header{"X-Guest": {"1"}}},
+		{name: "only invalid headers", response: response{Headers: http.Header{"Transfer-Encoding": {"chunked"}}}, status: http.StatusOK, headers: http.Header{}},
+		{name: "invalid trailer", response: response{Trailers: http.Header{"Te": {"trailers"}}}, status: http.StatusOK, headers: http.Header{}},
+		{name: "invalid status", response: response{Status: 42, Headers: http.Header{"X-Guest": {"1"}}}, status: http.StatusInternalServerError, headers: http.Header{}, err: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+
+			_, err := baseHandler{Response: tc.response, Action: ActionRespond}.stop(rec, zap.NewNop())
+			if tc.err != (err != nil) {
+				t.Errorf("got the error %v", err)
+			}
+
+			if rec.Code != tc.status {
+				t.Errorf("got the status %d, expected %d", rec.Code, tc.status)
+			}
+
+			if !reflect.DeepEqual(rec.Header(), tc.headers) {
+				t.Errorf("got the headers %v, expected %v", rec.Header(), tc.headers)
+			}
+		})
+	}
+}
+
+func TestJSResponsePhaseHopByHop(t *testing.T) {
+	next := HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) error {
+		rw.Header().Set("Connection", "close")
+		rw.Header().Set("X-Upstream", "1")
+		_, _ = rw.Write([]byte("upstream"))
+
+		return nil
+	})
+
+	rec, err := serveGuestWithNext(t, "js", BuilderOptions{Source: buildGuest(t, "js"), HandleResponse: true}, httptest.NewRequest(http.MethodGet, "/", nil), next)
+	if err != nil {
+		t.Fatalf("got the error %v", err)
+	}
+
+	if rec.Code != http.StatusOK || rec.Body.String() != "upstream" {
+		t.Errorf("got the status %d and the body %q, expected the upstream response", rec.Code, rec.Body.String())
+	}
+
+	if rec.Header().Get("Connection") != "" || rec.Header().Get("X-Upstream") != "1" {
+		t.Errorf("got the headers %v, expected the upstream ones without Connection", rec.Header())
+	}
+}
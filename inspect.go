@@ -0,0 +1,203 @@
+package wazemmes
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	wasmHeaderLength = 8
+	importSectionID  = 2
+	exportSectionID  = 7
+
+	externFunc   = 0
+	externTable  = 1
+	externMemory = 2
+	externGlobal = 3
+	externTag    = 4
+
+	// maxNameLength bounds the import and export names, a hostile length
+	// fails instead of allocating.
+	maxNameLength = 1 << 16
+)
+
+// moduleInterface is the imports and exports of a module, read from its
+// binary: wazero lists them once the module is compiled only, and never lists
+// the exported globals.
+type moduleInterface struct {
+	// imports are the names of the imported modules.
+	imports map[string]bool
+	// exports are the kinds of the exports by name.
+	exports map[string]byte
+}
+
+func (m moduleInterface) exportsFunction(name string) bool {
+	kind, ok := m.exports[name]
+
+	return ok && kind == externFunc
+}
+
+// inspectModule reads the import and export sections of a module.
+func inspectModule(code []byte) (moduleInterface, error) {
+	if len(code) < wasmHeaderLength || !bytes.HasPrefix(code, wasmMagic) {
+		return moduleInterface{}, errors.New("not a WASM module")
+	}
+
+	m := moduleInterface{imports: make(map[string]bool), exports: make(map[string]byte)}
+
+	reader := bytes.NewReader(code[wasmHeaderLength:])
+	for reader.Len() > 0 {
+		id, err := reader.ReadByte()
+		if err != nil {
+			return moduleInterface{}, err
+		}
+
+		size, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return moduleInterface{}, err
+		}
+
+		if size > uint64(reader.Len()) {
+			return moduleInterface{}, fmt.Errorf("the section %d exceeds the module", id)
+		}
+
+		offset := len(code) - reader.Len()
+		section := bytes.NewReader(code[offset : offset+int(size)])
+
+		switch id {
+		case importSectionID:
+			err = m.readImports(section)
+		case exportSectionID:
+			err = m.readExports(section)
+		}
+
+		if err != nil {
+			return moduleInterface{}, fmt.Errorf("invalid section %d: %w", id, err)
+		}
+
+		if _, err = reader.Seek(int64(size), io.SeekCurrent); err != nil {
+			return moduleInterface{}, err
+		}
+	}
+
+	return m, nil
+}
+
+func (m moduleInterface) readImports(r *bytes.Reader) error {
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return err
+	}
+
+	for range count {
+		module, err := readName(r)
+		if err != nil {
+			return err
+		}
+
+		if _, err = readName(r); err != nil {
+			return err
+		}
+
+		if err = skipImportDescriptor(r); err != nil {
+			return err
+		}
+
+		m.imports[module] = true
+	}
+
+	return nil
+}
+
+func (m moduleInterface) readExports(r *bytes.Reader) error {
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return err
+	}
+
+	for range count {
+		name, err := readName(r)
+		if err != nil {
+			return err
+		}
+
+		kind, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		if _, err = binary.ReadUvarint(r); err != nil {
+			return err
+		}
+
+		m.exports[name] = kind
+	}
+
+	return nil
+}
+
+func readName(r *bytes.Reader) (string, error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+
+	if length > maxNameLength || length > uint64(r.Len()) {
+		return "", fmt.Errorf("invalid name length %d", length)
+	}
+
+	name := make([]byte, length)
+	if _, err = io.ReadFull(r, name); err != nil {
+		return "", err
+	}
+
+	return string(name), nil
+}
+
+func skipImportDescriptor(r *bytes.Reader) error {
+	kind, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+
+	switch kind {
+	case externFunc:
+		_, err = binary.ReadUvarint(r)
+	case externTable:
+		if _, err = r.ReadByte(); err == nil {
+			err = skipLimits(r)
+		}
+	case externMemory:
+		err = skipLimits(r)
+	case externGlobal:
+		_, err = io.ReadFull(r, make([]byte, 2))
+	case externTag:
+		if _, err = r.ReadByte(); err == nil {
+			_, err = binary.ReadUvarint(r)
+		}
+	default:
+		err = fmt.Errorf("unknown import kind %d", kind)
+	}
+
+	return err
+}
+
+func skipLimits(r *bytes.Reader) error {
+	flags, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+
+	if _, err = binary.ReadUvarint(r); err != nil {
+		return err
+	}
+
+	if flags&1 != 0 {
+		_, err = binary.ReadUvarint(r)
+	}
+
+	return err
+}
@@ -0,0 +1,279 @@
+package wazemmes
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+// instance is a guest instance held by the pool, it is borrowed by a single
+// request at a time.
+type instance interface {
+	NewHandler(ctx context.Context, next Handler) Handler
+	Close(ctx context.Context) error
+}
+
+// funcInstance wraps a stateless handler, the next handler is called once it
+// succeeded.
+type funcInstance struct {
+	handler func(ctx context.Context, next Handler) Handler
+}
+
+func (f *funcInstance) NewHandler(ctx context.Context, next Handler) Handler {
+	return HandlerFunc(func(rw http.ResponseWriter, req *http.Request) error {
+		if result := f.handler(ctx, next); result != nil {
+			if err := result.ServeHTTP(rw, req); err != nil {
+				return err
+			}
+		}
+
+		if next != nil {
+			return next.ServeHTTP(rw, req)
+		}
+
+		return nil
+	})
+}
+
+func (*funcInstance) Close(context.Context) error {
+	return nil
+}
+
+type stdinProxy struct {
+	reader io.Reader
+}
+
+func (p *stdinProxy) Read(b []byte) (int, error) {
+	if p.reader == nil {
+		return 0, io.EOF
+	}
+
+	return p.reader.Read(b)
+}
+
+type stdoutProxy struct {
+	writer io.Writer
+}
+
+func (p *stdoutProxy) Write(b []byte) (int, error) {
+	if p.writer == nil {
+		return len(b), nil
+	}
+
+	return p.writer.Write(b)
+}
+
+// guestModule is a WASI command instantiated ahead of time. Its standard
+// input and output are bound when it runs, and it can run only once.
+type guestModule struct {
+	module  api.Module
+	entries []string
+	stdin   *stdinProxy
+	stdout  *stdoutProxy
+	// refill prepares the next module of its slot once it is closed.
+	refill func()
+}
+
+// instantiateGuest instantiates the module without running it, and restores
+// the snapshot state when one is given.
+func instantiateGuest(ctx context.Context, runtime wazero.Runtime, compiled wazero.CompiledModule, config wazero.ModuleConfig, snap *snapshot) (*guestModule, error) {
+	g := &guestModule{
+		entries: []string{"_start", "_initialize"},
+		stdin:   &stdinProxy{},
+		stdout:  &stdoutProxy{},
+	}
+
+	module, err := runtime.InstantiateModule(ctx, compiled, config.
+		WithName("").
+		WithStartFunctions().
+		WithStdin(g.stdin).
+		WithStdout(g.stdout))
+	if err != nil {
+		return nil, err
+	}
+
+	g.module = module
+
+	if snap != nil {
+		if err = snap.restore(module); err != nil {
+			_ = module.Close(ctx)
+
+			return nil, err
+		}
+
+		g.entries = []string{snap.entry}
+	}
+
+	return g, nil
+}
+
+// run calls the entry functions reading stdin and writing to stdout, the
+// module is closed once it returns.
+func (g *guestModule) run(ctx context.Context, stdin io.Reader, stdout io.Writer) error {
+	g.stdin.reader = stdin
+	g.stdout.writer = stdout
+
+	defer func() {
+		_ = g.Close(ctx)
+	}()
+
+	for _, name := range g.entries {
+		fn := g.module.ExportedFunction(name)
+		if fn == nil {
+			continue
+		}
+
+		if _, err := fn.Call(ctx); err != nil {
+			var exitErr *sys.ExitError
+			if errors.As(err, &exitErr) && exitErr.ExitCode() == 0 {
+				return nil
+			}
+
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (g *guestModule) Close(ctx context.Context) error {
+	err := g.module.Close(ctx)
+
+	if refill := g.refill; refill != nil {
+		g.refill = nil
+		refill()
+	}
+
+	return err
+}
+
+// guestSlots holds an instance of each module of a handler, instantiated
+// ahead of the request. Once the module taken by a request ran, the next one
+// is instantiated in the background, off the request path.
+type guestSlots struct {
+	instantiate func(ctx context.Context, module int) (*guestModule, error)
+
+	mu     sync.Mutex
+	guests []*pendingGuest
+	closed bool
+}
+
+// pendingGuest is a module being instantiated, ready is closed once done.
+type pendingGuest struct {
+	ready chan struct{}
+	guest *guestModule
+	err   error
+}
+
+// newGuestSlots instantiates the modules right away, to fail fast.
+func newGuestSlots(ctx context.Context, modules int, instantiate func(ctx context.Context, module int) (*guestModule, error)) (*guestSlots, error) {
+	s := &guestSlots{instantiate: instantiate, guests: make([]*pendingGuest, modules)}
+
+	for i := range s.guests {
+		guest, err := instantiate(ctx, i)
+		if err != nil {
+			_ = s.Close(ctx)
+
+			return nil, err
+		}
+
+		ready := make(chan struct{})
+		close(ready)
+
+		s.guests[i] = &pendingGuest{ready: ready, guest: guest}
+	}
+
+	return s, nil
+}
+
+// take returns the instance of the module, it waits for the one being
+// instantiated in the background if any. A fresh one is instantiated when
+// the slot is empty or its instantiation failed.
+func (s *guestSlots) take(ctx context.Context, module int) (*guestModule, error) {
+	s.mu.Lock()
+	pending := s.guests[module]
+	s.guests[module] = nil
+	s.mu.Unlock()
+
+	var (
+		guest *guestModule
+		err   error
+	)
+
+	if pending != nil {
+		select {
+		case <-pending.ready:
+			guest, err = pending.guest, pending.err
+		case <-ctx.Done():
+			go pending.close()
+
+			return nil, ctx.Err()
+		}
+	}
+
+	if guest == nil || err != nil {
+		if guest, err = s.instantiate(ctx, module); err != nil {
+			return nil, err
+		}
+	}
+
+	guest.refill = func() {
+		s.refill(module)
+	}
+
+	return guest, nil
+}
+
+// refill instantiates the module of the slot in the background.
+func (s *guestSlots) refill(module int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed || s.guests[module] != nil {
+		return
+	}
+
+	pending := &pendingGuest{ready: make(chan struct{})}
+	s.guests[module] = pending
+
+	go func() {
+		pending.guest, pending.err = s.instantiate(context.Background(), module)
+		close(pending.ready)
+	}()
+}
+
+// Close waits for the modules being instantiated, then closes them.
+func (s *guestSlots) Close(context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	guests := s.guests
+	s.guests = make([]*pendingGuest, len(guests))
+	s.mu.Unlock()
+
+	errs := make([]error, 0, len(guests))
+
+	for _, pending := range guests {
+		if pending != nil {
+			errs = append(errs, pending.close())
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// close closes the module once instantiated.
+func (p *pendingGuest) close() error {
+	<-p.ready
+
+	if p.guest == nil {
+		return nil
+	}
+
+	return p.guest.Close(context.Background())
+}
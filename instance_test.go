@@ -0,0 +1,129 @@
+package wazemmes
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+)
+
+func TestGuestSlotsRefillInBackground(t *testing.T) {
+	ctx := context.Background()
+
+	runtime := wazero.NewRuntime(ctx)
+	defer runtime.Close(ctx)
+
+	compiled, err := runtime.CompileModule(ctx, []byte("\x00asm\x01\x00\x00\x00"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	instantiated, unblock := make(chan struct{}, 8), make(chan struct{})
+	blocked := false
+
+	slots, err := newGuestSlots(ctx, 1, func(ctx context.Context, _ int) (*guestModule, error) {
+		if blocked {
+			<-unblock
+		}
+
+		defer func() {
+			instantiated <- struct{}{}
+		}()
+
+		return instantiateGuest(ctx, runtime, compiled, wazero.NewModuleConfig(), nil)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	<-instantiated
+
+	blocked = true
+
+	guest, err := slots.take(ctx, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The module that ran is closed without waiting for the next one.
+	closed := make(chan error, 1)
+	go func() {
+		closed <- guest.run(ctx, nil, nil)
+	}()
+
+	select {
+	case err = <-closed:
+		if err != nil {
+			t.Fatalf("got the error %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the run waited for the next module")
+	}
+
+	select {
+	case <-instantiated:
+		t.Fatal("the next module was instantiated before being unblocked")
+	default:
+	}
+
+	close(unblock)
+
+	// The next request takes the module instantiated in the background.
+	if guest, err = slots.take(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	<-instantiated
+
+	if err = guest.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = slots.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-instantiated:
+	case <-time.After(time.Second):
+		t.Fatal("the closed module wasn't refilled")
+	}
+}
+
+func TestGuestSlotsTakeCanceled(t *testing.T) {
+	ctx := context.Background()
+
+	runtime := wazero.NewRuntime(ctx)
+	defer runtime.Close(ctx)
+
+	compiled, err := runtime.CompileModule(ctx, []byte("\x00asm\x01\x00\x00\x00"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unblock := make(chan struct{})
+	slots := &guestSlots{
+		instantiate: func(ctx context.Context, _ int) (*guestModule, error) {
+			<-unblock
+
+			return instantiateGuest(ctx, runtime, compiled, wazero.NewModuleConfig(), nil)
+		},
+		guests: make([]*pendingGuest, 1),
+	}
+
+	slots.refill(0)
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+
+	if _, err = slots.take(canceled, 0); err == nil {
+		t.Fatal("the take didn't stop with the context")
+	}
+
+	close(unblock)
+
+	if err = slots.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
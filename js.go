@@ -4,54 +4,155 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/tetratelabs/wazero"
-	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
 	"go.uber.org/zap"
 )
 
 type request struct {
 	Headers http.Header `json:"headers"`
 	URL     *url.URL    `json:"url"`
-	Body    string      `json:"body"`
-	Method  string      `json:"method"`
+	// Body is binary safe, see encodeBody.
+	Body   string `json:"-"`
+	Method string `json:"method"`
+	// Stream tells the guest that the body follows the message on its stdin.
+	Stream bool `json:"stream,omitempty"`
+	// version selects the encoding of the URL.
+	version int
+	// bodySet is true when the guest returned a body.
+	bodySet bool
 }
 
 type response struct {
-	Headers http.Header `json:"headers"`
-	Body    string      `json:"body"`
-	Status  int         `json:"status"`
+	Headers  http.Header `json:"headers"`
+	Trailers http.Header `json:"trailers,omitempty"`
+	// Body is binary safe, see encodeBody.
+	Body   string `json:"-"`
+	Status int    `json:"status"`
 }
 
 type baseHandler struct {
 	Request  request  `json:"request"`
 	Response response `json:"response"`
 	Error    string   `json:"error"`
+	// Action tells the host how to continue the chain, see ActionContinue.
+	Action string `json:"action,omitempty"`
+	// Version is the protocol version spoken by the guest, it is only read
+	// from the handshake output.
+	Version int `json:"version,omitempty"`
 }
 
 type Input struct {
 	BaseHandler baseHandler `json:"-"`
 	Context     string      `json:"context"`
+	// Version is the negotiated protocol version, see ProtocolVersion.
+	Version int `json:"version"`
+}
+
+// MarshalJSON flattens the base handler next to the context and the version
+// as the guests expect it.
+func (i Input) MarshalJSON() ([]byte, error) {
+	i.BaseHandler.Request.version = i.Version
+
+	return json.Marshal(struct {
+		baseHandler
+		Context string `json:"context"`
+		Version int    `json:"version"`
+	}{
+		baseHandler: i.BaseHandler,
+		Context:     i.Context,
+		Version:     i.Version,
+	})
 }
+
 type Output = baseHandler
 
-func NewWasmHandlerJS(modulepath string, _ any, poolConfiguration map[string]interface{},
+// apply returns a copy of the HTTP request carrying the method, URL, headers
+// and body returned by the guest. The returned headers are merged as the
+// response ones, see applyHeaders: the headers the guest omits are kept.
+func (r request) apply(httpReq *http.Request) *http.Request {
+	mutated := httpReq.WithContext(httpReq.Context())
+
+	mutated.Header = httpReq.Header.Clone()
+	if mutated.Header == nil {
+		mutated.Header = http.Header{}
+	}
+
+	if r.Method != "" {
+		mutated.Method = r.Method
+	}
+
+	if r.URL != nil {
+		mutated.URL = r.URL
+		mutated.RequestURI = r.URL.RequestURI()
+
+		if r.URL.Host != "" {
+			mutated.Host = r.URL.Host
+		}
+	}
+
+	applyHeaders(mutated.Header, r.Headers)
+
+	if !r.bodySet {
+		return mutated
+	}
+
+	mutated.Body = io.NopCloser(strings.NewReader(r.Body))
+	mutated.ContentLength = int64(len(r.Body))
+
+	if mutated.Header.Get("Content-Length") != "" {
+		mutated.Header.Set("Content-Length", strconv.Itoa(len(r.Body)))
+	}
+
+	return mutated
+}
+
+func newRequest(httpReq *http.Request, body string) request {
+	return request{
+		Headers: httpReq.Header,
+		URL:     httpReq.URL,
+		Body:    body,
+		Method:  httpReq.Method,
+	}
+}
+
+func NewWasmHandlerJS(modulepath string, moduleConfig any, poolConfiguration map[string]interface{},
 	logger *zap.Logger) (*WasmHandler, error) {
-	ctx := context.Background()
+	return NewWasmHandlerJSFromSource(NewFileSource(modulepath), moduleConfig, poolConfiguration, logger)
+}
+
+func NewWasmHandlerJSFromSource(source ModuleSource, moduleConfig any, poolConfiguration map[string]interface{},
+	logger *zap.Logger) (*WasmHandler, error) {
+	return newWasmHandlerJS(BuilderOptions{
+		Source:        source,
+		Configuration: moduleConfig,
+		Pool:          poolConfiguration,
+		Logger:        logger,
+	})
+}
 
-	runtime := wazero.NewRuntime(ctx)
+func newWasmHandlerJS(o BuilderOptions) (_ *WasmHandler, err error) {
+	ctx := context.Background()
 
-	if _, err := wasi_snapshot_preview1.Instantiate(ctx, runtime); err != nil {
-		return nil, fmt.Errorf("failed to instantiate WASI: %w", err)
+	runtime, err := newWASIRuntime(ctx, o)
+	if err != nil {
+		return nil, err
 	}
 
-	wasmFile, err := os.ReadFile(modulepath)
+	defer func() {
+		if err != nil {
+			_ = runtime.Close(ctx)
+		}
+	}()
+
+	wasmFile, err := o.Source.Bytes()
 	if err != nil {
 		return nil, fmt.Errorf("failed to read WASM module: %w", err)
 	}
@@ -64,84 +165,381 @@ func NewWasmHandlerJS(modulepath string, _ any, poolConfiguration map[string]int
 	wasmHandlerJS := &JSWASMHandler{
 		runtime:        runtime,
 		compiledModule: compiled,
+		handleResponse: o.HandleResponse,
+		streamBody:     o.StreamBody,
+		maxBodySize:    o.MaxBodySize,
+		streamResponse: o.StreamResponse,
+		logger:         o.Logger,
 	}
-	return NewWasmHandlerInstance(
-		func(ctx context.Context, next Handler) Handler {
-			return wasmHandlerJS
-		},
-		poolConfiguration,
-		logger,
-	)
+
+	if o.Snapshot != nil {
+		wasmHandlerJS.snapshot, err = takeSnapshot(ctx, runtime, compiled, wasmFile, wasmHandlerJS.moduleConfig(), *o.Snapshot)
+		if err != nil {
+			return nil, fmt.Errorf("impossible to snapshot %s: %w", o.Source.Name(), err)
+		}
+	}
+
+	wasmHandlerJS.codec, err = codecFor(o.Encoding)
+	if err != nil {
+		return nil, err
+	}
+
+	wasmHandlerJS.version = wasmHandlerJS.negotiate(ctx)
+
+	w, err := newWasmHandler(withMemoryBudget(o.memoryBudget(), wasmHandlerJS.newInstance, memoryReservation(o, compiled)), o.Pool, o.Logger)
+	if err != nil {
+		return nil, err
+	}
+
+	w.onClose(runtime.Close)
+
+	return w, nil
 }
 
 type JSWASMHandler struct {
 	runtime        wazero.Runtime
 	compiledModule wazero.CompiledModule
+	snapshot       *snapshot
+	// handleResponse calls the guest a second time with the downstream
+	// response, in the "response" context.
+	handleResponse bool
+	// version is the protocol version negotiated with the guest.
+	version int
+	// codec encodes the inputs of the guest, the outputs are decoded in the
+	// encoding the guest chose.
+	codec codec
+	// streamBody streams the request body after the message instead of
+	// embedding it, bodies larger than maxBodySize are rejected.
+	streamBody  bool
+	maxBodySize int64
+	// streamResponse writes the guest output following the message to the
+	// client as it comes.
+	streamResponse bool
+	logger         *zap.Logger
 }
 
+// jsInstance keeps a guest module instantiated ahead of the next request.
+type jsInstance struct {
+	*guestSlots
+	handler *JSWASMHandler
+}
+
+func (h *JSWASMHandler) newInstance(ctx context.Context) (instance, error) {
+	slots, err := newGuestSlots(ctx, 1, func(ctx context.Context, _ int) (*guestModule, error) {
+		return h.instantiate(ctx)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &jsInstance{guestSlots: slots, handler: h}, nil
+}
+
+func (h *JSWASMHandler) moduleConfig() wazero.ModuleConfig {
+	return wazero.NewModuleConfig().
+		WithSysWalltime().
+		WithStderr(os.Stderr)
+}
+
+func (h *JSWASMHandler) instantiate(ctx context.Context) (*guestModule, error) {
+	guest, err := instantiateGuest(ctx, h.runtime, h.compiledModule, h.moduleConfig(), h.snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("failed to instantiate WASM module: %w", err)
+	}
+
+	return guest, nil
+}
+
+func (i *jsInstance) NewHandler(_ context.Context, next Handler) Handler {
+	return HandlerFunc(func(rw http.ResponseWriter, req *http.Request) error {
+		return i.handler.serve(rw, req, i.take, next)
+	})
+}
+
+// take returns the guest module instantiated ahead, the response phase takes
+// the one instantiated while the next handlers ran.
+func (i *jsInstance) take(ctx context.Context) (*guestModule, error) {
+	return i.guestSlots.take(ctx, 0)
+}
+
+// ServeHTTP runs the request phase of the module in a fresh instance, outside
+// of any pool.
 func (h *JSWASMHandler) ServeHTTP(rw http.ResponseWriter, httpReq *http.Request) error {
+	return h.serve(rw, httpReq, h.instantiate, nil)
+}
+
+// invoke runs a guest module with the input on its stdin followed by the
+// streamed body if any, and decodes the output from its stdout. The request
+// fields omitted by the guest keep their input value.
+//
+// With a stream function, the output is handed to it as soon as the guest
+// wrote it, and what the guest writes next goes to the returned writer.
+func (h *JSWASMHandler) invoke(
+	ctx context.Context,
+	take func(context.Context) (*guestModule, error),
+	input Input,
+	body io.Reader,
+	stream func(Output) io.Writer,
+) (Output, error) {
+	output := Output{
+		Request: request{
+			Body:   input.BaseHandler.Request.Body,
+			Method: input.BaseHandler.Request.Method,
+		},
+	}
+
+	output.Request.URL = input.BaseHandler.Request.URL
+
+	guest, err := take(ctx)
+	if err != nil {
+		return output, err
+	}
+
+	stdin, stdout := getBuffer(), getBuffer()
+	defer putBuffer(stdin)
+	defer putBuffer(stdout)
+
+	// The handshake is always in JSON, the guest doesn't know the encoding yet.
+	var encoder codec = jsonCodec{}
+	if input.Context != HandshakeContext && h.codec != nil {
+		encoder = h.codec
+	}
+
+	if err = encoder.encode(stdin, input); err != nil {
+		return output, err
+	}
+
+	var guestStdin io.Reader = stdin
+	if body != nil {
+		guestStdin = io.MultiReader(stdin, body)
+	}
+
+	var guestStdout io.Writer = stdout
+
+	if stream != nil {
+		guestStdout = &streamWriter{
+			parse: func(data []byte) (int, bool, error) {
+				return splitOutput(data, &output)
+			},
+			onHeader: func([]byte) (io.Writer, error) {
+				return stream(output), nil
+			},
+		}
+	}
+
+	if err = guest.run(ctx, guestStdin, guestStdout); err != nil {
+		return output, fmt.Errorf("failed to run WASM module: %w", err)
+	}
+
+	if w, ok := guestStdout.(*streamWriter); ok {
+		if w.started() {
+			return output, nil
+		}
+
+		stdout = &w.buf
+	}
+
+	// In streaming mode, the bytes following the message continue the
+	// response body as they would have been streamed. They are ignored
+	// otherwise, as the guests printing after their message expect it.
+	n, ok, err := splitOutput(stdout.Bytes(), &output)
+	if err == nil && !ok {
+		err = decodeOutput(stdout.Bytes(), &output)
+	}
+
+	if err != nil {
+		return output, fmt.Errorf("failed to decode the WASM module output: %w", err)
+	}
+
+	if ok && stream != nil {
+		output.Response.Body += string(stdout.Bytes()[n:])
+	}
+
+	return output, nil
+}
+
+// serve runs the request phase, then the next handler. When the response
+// phase is enabled, the downstream response is recorded and handed to the
+// guest, which output is written instead.
+func (h *JSWASMHandler) serve(rw http.ResponseWriter, httpReq *http.Request, take func(context.Context) (*guestModule, error), next Handler) error {
 	ctx := httpReq.Context()
 
-	var buf bytes.Buffer
-	if httpReq.Body != nil {
-		_, _ = io.Copy(&buf, httpReq.Body)
+	if !limitBody(rw, httpReq, h.maxBodySize) {
+		return rejectBody(rw)
+	}
+
+	req := newRequest(httpReq, "")
+
+	var (
+		body   io.Reader
+		finish func() error
+	)
+
+	if h.streamBody {
+		var bodySpool *spool
+
+		body, bodySpool, finish = streamBody(httpReq)
+		defer bodySpool.Close()
+
+		req.Stream = true
+	} else if httpReq.Body != nil {
+		var buf bytes.Buffer
+		if _, err := io.Copy(&buf, httpReq.Body); err != nil {
+			if isBodyTooLarge(err) {
+				return rejectBody(rw)
+			}
+
+			return err
+		}
+
 		_ = httpReq.Body.Close()
 		httpReq.Body = io.NopCloser(bytes.NewBuffer(buf.Bytes()))
+		req.Body = buf.String()
 	}
 
-	req := request{
-		Headers: httpReq.Header,
-		URL:     httpReq.URL,
-		Body:    buf.String(),
-		Method:  httpReq.Method,
-	}
-	res := response{
-		Headers: httpReq.Header,
-		Body:    buf.String(),
-		Status:  0,
+	// A streamed response is answered as soon as the guest wrote its output.
+	var (
+		answered bool
+		stopped  bool
+		stopErr  error
+		stream   func(Output) io.Writer
+	)
+
+	if h.streamResponse {
+		stream = func(output Output) io.Writer {
+			answered = true
+			stopped, stopErr = h.answer(rw, output, next)
+
+			if stopErr != nil || output.Action == ActionContinue || !stopped && h.handleResponse && next != nil {
+				return io.Discard
+			}
+
+			return newFlushWriter(rw)
+		}
 	}
 
-	reqBytes, _ := json.Marshal(Input{
+	output, err := h.invoke(ctx, take, Input{
 		BaseHandler: baseHandler{
-			Request:  req,
-			Response: res,
-			Error:    "",
+			Request: req,
+			Response: response{
+				Headers: http.Header{},
+			},
 		},
 		Context: "request",
-	})
-	stdin := bytes.NewBuffer(reqBytes)
-	stdout := new(bytes.Buffer)
+		Version: h.version,
+	}, body, stream)
 
-	config := wazero.NewModuleConfig().
-		WithSysWalltime().
-		WithStartFunctions("_start", "_initialize").
-		WithStdin(stdin).
-		WithStdout(stdout).
-		WithStderr(os.Stderr)
+	// The rest of a streamed body is kept for the downstream handlers, a body
+	// exceeding the maximum size fails the guest read too.
+	if finish != nil && isBodyTooLarge(finish()) {
+		if answered {
+			return ErrBodyTooLarge
+		}
 
-	module, _ := h.runtime.InstantiateModule(ctx, h.compiledModule, config)
+		return rejectBody(rw)
+	}
 
-	defer func() {
-		_ = module.Close(ctx)
-	}()
+	if err != nil {
+		return err
+	}
 
-	var response baseHandler
-	_ = json.NewDecoder(bytes.NewReader(stdout.Bytes())).Decode(&response)
+	if !answered {
+		stopped, stopErr = h.answer(rw, output, next)
+	}
+
+	if stopped {
+		return stopErr
+	}
 
-	if response.Error != "" {
-		rw.WriteHeader(http.StatusInternalServerError)
-		_, _ = rw.Write([]byte(response.Error))
+	// The downstream handlers receive the request as the guest returned it.
+	httpReq = output.Request.apply(httpReq)
+	req = newRequest(httpReq, output.Request.Body)
 
-		return errors.New(response.Error)
+	if !h.handleResponse || next == nil {
+		if next != nil {
+			return next.ServeHTTP(rw, httpReq)
+		}
+
+		return nil
 	}
 
-	for key, values := range response.Response.Headers {
-		for _, value := range values {
-			rw.Header().Set(key, value)
+	upstream := newRecorder()
+	if err = next.ServeHTTP(upstream, httpReq); err != nil {
+		return err
+	}
+
+	answered = false
+
+	if h.streamResponse {
+		stream = func(output Output) io.Writer {
+			answered = true
+
+			if _, stopErr = h.respondWith(rw, output, upstream); stopErr != nil {
+				return io.Discard
+			}
+
+			return newFlushWriter(rw)
 		}
 	}
 
-	_, _ = rw.Write([]byte(response.Response.Body))
+	output, err = h.invoke(ctx, take, Input{
+		BaseHandler: baseHandler{
+			Request: req,
+			Response: response{
+				Headers: upstream.Header(),
+				Body:    upstream.body.String(),
+				Status:  upstream.status,
+			},
+		},
+		Context: "response",
+		Version: h.version,
+	}, nil, stream)
+	if err != nil {
+		return err
+	}
+
+	if answered {
+		return stopErr
+	}
+
+	_, err = h.respondWith(rw, output, upstream)
+
+	return err
+}
+
+// answer applies the output of the request phase, and tells whether the
+// chain ends here. Without action, the guest body is written unless the
+// response phase answers instead: the response headers of the request phase
+// are then only sent when the guest ends the chain, the response phase
+// returns the headers of the client response.
+func (h *JSWASMHandler) answer(rw http.ResponseWriter, output Output, next Handler) (bool, error) {
+	if h.handleResponse && next != nil && (output.Action == "" || output.Action == ActionContinue) {
+		output.Response.Headers = nil
+	}
+
+	if stop, err := output.stop(rw, h.logger); stop {
+		return true, err
+	}
+
+	if output.Action == "" && (!h.handleResponse || next == nil) {
+		output.Response.write(rw, output.Response.Status)
+	}
+
+	return false, nil
+}
+
+// respondWith writes the output of the response phase, the upstream headers
+// and status are kept when the guest omits them.
+func (h *JSWASMHandler) respondWith(rw http.ResponseWriter, output Output, upstream *recorder) (bool, error) {
+	if output.Response.Headers == nil {
+		output.Response.Headers = upstream.Header()
+	}
+
+	if output.Response.Status == 0 {
+		output.Response.Status = upstream.status
+	}
+
+	output.Action = ActionRespond
 
-	return nil
+	return output.stop(rw, h.logger)
 }
@@ -0,0 +1,158 @@
+package wazemmes
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestJSResponsePhaseHeaders(t *testing.T) {
+	next := HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) error {
+		rw.Header().Set("X-Upstream", "1")
+		_, _ = rw.Write([]byte("upstream"))
+
+		return nil
+	})
+
+	for _, tc := range []struct {
+		name         string
+		options      BuilderOptions
+		guestHeader  string
+		upstreamBody bool
+	}{
+		{name: "request phase", guestHeader: "request"},
+		{name: "response phase", options: BuilderOptions{HandleResponse: true}, upstreamBody: true},
+		{name: "streamed response phase", options: BuilderOptions{HandleResponse: true, StreamResponse: true}, upstreamBody: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.options.Source = buildGuest(t, "js")
+
+			rec, err := serveGuestWithNext(t, "js", tc.options, httptest.NewRequest(http.MethodGet, "/", nil), next)
+			if err != nil {
+				t.Fatalf("got the error %v", err)
+			}
+
+			if got := rec.Header().Get("X-Guest"); got != tc.guestHeader {
+				t.Errorf("got the X-Guest header %q, expected %q", got, tc.guestHeader)
+			}
+
+			if tc.upstreamBody && (rec.Body.String() != "upstream" || rec.Header().Get("X-Upstream") != "1") {
+				t.Errorf("got the body %q and headers %v, expected the upstream response", rec.Body.String(), rec.Header())
+			}
+		})
+	}
+}
+
+func TestRequestApply(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		output        string
+		method        string
+		uri           string
+		headers       http.Header
+		body          string
+		contentLength int64
+	}{
+		{
+			name:    "omitted fields",
+			output:  `{}`,
+			method:  http.MethodPost,
+			uri:     "/path?q=1",
+			headers: http.Header{"Accept": {"text/html"}, "Cookie": {"a=1"}, "Content-Length": {"4"}},
+			body:    "body", contentLength: 4,
+		},
+		{
+			name:    "empty headers",
+			output:  `{"headers":{}}`,
+			method:  http.MethodPost,
+			uri:     "/path?q=1",
+			headers: http.Header{"Accept": {"text/html"}, "Cookie": {"a=1"}, "Content-Length": {"4"}},
+			body:    "body", contentLength: 4,
+		},
+		{
+			name:    "merged headers",
+			output:  `{"headers":{"accept":["application/json","text/plain"],"Cookie":null,"X-Added":["1"],"Content-Length":["100"]}}`,
+			method:  http.MethodPost,
+			uri:     "/path?q=1",
+			headers: http.Header{"Accept": {"application/json", "text/plain"}, "X-Added": {"1"}, "Content-Length": {"4"}},
+			body:    "body", contentLength: 4,
+		},
+		{
+			name:    "empty values",
+			output:  `{"headers":{"Cookie":[]}}`,
+			method:  http.MethodPost,
+			uri:     "/path?q=1",
+			headers: http.Header{"Accept": {"text/html"}, "Content-Length": {"4"}},
+			body:    "body", contentLength: 4,
+		},
+		{
+			name:    "method, URL and body",
+			output:  `{"method":"PUT","url":"/rewritten","body":"changed"}`,
+			method:  http.MethodPut,
+			uri:     "/rewritten",
+			headers: http.Header{"Accept": {"text/html"}, "Cookie": {"a=1"}, "Content-Length": {"7"}},
+			body:    "changed", contentLength: 7,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			httpReq := httptest.NewRequest(http.MethodPost, "/path?q=1", strings.NewReader("body"))
+			httpReq.Header = http.Header{"Accept": {"text/html"}, "Cookie": {"a=1"}, "Content-Length": {"4"}}
+			incoming := httpReq.Header.Clone()
+
+			// The output starts as invoke seeds it.
+			r := request{Body: "body", Method: httpReq.Method, URL: httpReq.URL}
+			if err := json.Unmarshal([]byte(tc.output), &r); err != nil {
+				t.Fatal(err)
+			}
+
+			mutated := r.apply(httpReq)
+
+			if mutated.Method != tc.method || mutated.URL.RequestURI() != tc.uri {
+				t.Errorf("got the request %s %s, expected %s %s", mutated.Method, mutated.URL.RequestURI(), tc.method, tc.uri)
+			}
+
+			if !reflect.DeepEqual(mutated.Header, tc.headers) {
+				t.Errorf("got the headers %v, expected %v", mutated.Header, tc.headers)
+			}
+
+			if body, _ := io.ReadAll(mutated.Body); string(body) != tc.body || mutated.ContentLength != tc.contentLength {
+				t.Errorf("got the body %q of length %d, expected %q of length %d", body, mutated.ContentLength, tc.body, tc.contentLength)
+			}
+
+			if !reflect.DeepEqual(httpReq.Header, incoming) {
+				t.Errorf("the incoming headers were modified to %v", httpReq.Header)
+			}
+		})
+	}
+}
+
+func TestJSTrailingOutput(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		options  BuilderOptions
+		expected string
+	}{
+		{name: "buffered", expected: "guest"},
+		{name: "streamed", options: BuilderOptions{StreamResponse: true}, expected: "guest trailing"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.options.Source = buildGuest(t, "js")
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("X-Trailing", " trailing")
+
+			rec, err := serveGuest(t, "js", tc.options, req)
+			if err != nil {
+				t.Fatalf("got the error %v", err)
+			}
+
+			if rec.Body.String() != tc.expected {
+				t.Errorf("got the body %q, expected %q", rec.Body.String(), tc.expected)
+			}
+		})
+	}
+}
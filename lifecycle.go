@@ -0,0 +1,115 @@
+package wazemmes
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	pool "github.com/jolestar/go-commons-pool/v2"
+)
+
+var ErrHandlerClosed = errors.New("the WASM handler is closed")
+
+// generation holds the resources of one build of the module, a hot reload
+// replaces the whole generation.
+type generation struct {
+	pool *pool.ObjectPool
+	// closers release the runtimes and compiled modules, they run in the
+	// reverse order once the pool is closed.
+	closers []func(context.Context) error
+
+	mu       sync.RWMutex
+	closed   bool
+	inflight sync.WaitGroup
+}
+
+// enter registers an in-flight request, it fails once the generation is
+// closing.
+func (g *generation) enter() bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	if g.closed {
+		return false
+	}
+
+	g.inflight.Add(1)
+
+	return true
+}
+
+func (g *generation) leave() {
+	g.inflight.Done()
+}
+
+// close waits for the in-flight requests, or the context to be done, then
+// closes the pooled instances, the compiled modules and the runtimes.
+func (g *generation) close(ctx context.Context) error {
+	g.mu.Lock()
+	g.closed = true
+	g.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		g.inflight.Wait()
+		close(drained)
+	}()
+
+	var errs []error
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		errs = append(errs, ctx.Err())
+	}
+
+	g.pool.Close(ctx)
+
+	for i := len(g.closers) - 1; i >= 0; i-- {
+		errs = append(errs, g.closers[i](ctx))
+	}
+
+	return errors.Join(errs...)
+}
+
+// onClose registers a resource released with the current generation.
+func (w *WasmHandler) onClose(closer func(context.Context) error) {
+	gen := w.generation.Load()
+	gen.closers = append(gen.closers, closer)
+}
+
+// acquire returns the current generation with the request registered as
+// in-flight.
+func (w *WasmHandler) acquire() (*generation, error) {
+	for {
+		gen := w.generation.Load()
+		if gen == nil {
+			return nil, ErrHandlerClosed
+		}
+
+		if gen.enter() {
+			return gen, nil
+		}
+		// The generation was replaced by a reload, or the handler is closing.
+	}
+}
+
+// Close drains the in-flight requests, then releases the pooled instances,
+// the compiled modules, the runtimes and the shared sources. The handler
+// can't serve requests anymore.
+func (w *WasmHandler) Close(ctx context.Context) error {
+	w.closeOnce.Do(func() {
+		close(w.done)
+
+		for _, source := range w.shared {
+			source.release()
+		}
+	})
+
+	gen := w.generation.Swap(nil)
+	if gen == nil {
+		return nil
+	}
+
+	return gen.close(ctx)
+}
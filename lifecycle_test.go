@@ -0,0 +1,97 @@
+package wazemmes
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// servePending serves a request continued by the guest, next blocks until
+// release is closed.
+func servePending(t *testing.T, h *WasmHandler) (chan struct{}, chan error) {
+	t.Helper()
+
+	entered, release, served := make(chan struct{}), make(chan struct{}), make(chan error, 1)
+
+	next := HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+		close(entered)
+		<-release
+
+		return nil
+	})
+
+	go func() {
+		served <- h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/continue", nil), next)
+	}()
+
+	<-entered
+
+	return release, served
+}
+
+func newCGIHandler(t *testing.T) *WasmHandler {
+	t.Helper()
+
+	h, err := NewWasmHandlerWithOptions("cgi", BuilderOptions{Source: buildGuest(t, "cgi"), Logger: zap.NewNop()})
+	if err != nil {
+		t.Fatalf("impossible to build the handler: %v", err)
+	}
+
+	return h
+}
+
+func TestCloseDrainsTheGeneration(t *testing.T) {
+	h := newCGIHandler(t)
+	release, served := servePending(t, h)
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- h.Close(context.Background())
+	}()
+
+	select {
+	case err := <-closed:
+		t.Fatalf("closed with the error %v while a request is in flight", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil), nil); !errors.Is(err, ErrHandlerClosed) {
+		t.Errorf("got the error %v while closing", err)
+	}
+
+	close(release)
+
+	if err := <-served; err != nil {
+		t.Errorf("the in-flight request got the error %v", err)
+	}
+
+	if err := <-closed; err != nil {
+		t.Errorf("got the error %v once drained", err)
+	}
+
+	if err := h.Close(context.Background()); err != nil {
+		t.Errorf("got the error %v closing twice", err)
+	}
+}
+
+func TestCloseStopsWaitingOnContext(t *testing.T) {
+	h := newCGIHandler(t)
+	release, served := servePending(t, h)
+
+	defer func() {
+		close(release)
+		<-served
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if err := h.Close(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got the error %v, expected %v", err, context.DeadlineExceeded)
+	}
+}
@@ -0,0 +1,151 @@
+package wazemmes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/tetratelabs/wazero"
+)
+
+// maxMemoryPages is the wazero default limit, 4GiB.
+const maxMemoryPages = 65536
+
+var ErrMemoryBudgetExhausted = errors.New("the WASM memory budget is exhausted")
+
+// MemoryBudget bounds the memory reserved by the guest instances of the
+// WasmHandlers built with it, see BuilderOptions.MemoryBudget.
+type MemoryBudget struct {
+	mu       sync.Mutex
+	limit    uint64
+	used     uint64
+	queue    bool
+	released chan struct{}
+}
+
+// NewMemoryBudget bounds the memory reserved by the instances of the handlers
+// built with it, 0 disables it. Each instance reserves its memory limit, or
+// the maximum declared by the module. When queue is true, the new instances
+// wait for the memory to be released instead of being rejected.
+func NewMemoryBudget(limit uint64, queue bool) *MemoryBudget {
+	return &MemoryBudget{limit: limit, queue: queue, released: make(chan struct{})}
+}
+
+// budget is the budget of the handlers built without their own.
+var budget = NewMemoryBudget(0, false)
+
+type noQueueKey struct{}
+
+// withoutQueue rejects the instantiation instead of waiting for memory, e.g.
+// while provisioning, when the old handlers are still holding their memory.
+func withoutQueue(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noQueueKey{}, true)
+}
+
+// SetMemoryBudget bounds the memory reserved by the guest instances of every
+// WasmHandler built without a MemoryBudget, see NewMemoryBudget.
+func SetMemoryBudget(limit uint64, queue bool) {
+	budget.mu.Lock()
+	defer budget.mu.Unlock()
+
+	budget.limit = limit
+	budget.queue = queue
+}
+
+func (b *MemoryBudget) acquire(ctx context.Context, size uint64) error {
+	for {
+		b.mu.Lock()
+		if b.limit == 0 || b.used+size <= b.limit {
+			b.used += size
+			b.mu.Unlock()
+
+			return nil
+		}
+
+		limit, queue, released := b.limit, b.queue, b.released
+		b.mu.Unlock()
+
+		if !queue || size > limit || ctx.Value(noQueueKey{}) != nil {
+			return fmt.Errorf("%w: %d bytes requested out of %d", ErrMemoryBudgetExhausted, size, limit)
+		}
+
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %w", ErrMemoryBudgetExhausted, ctx.Err())
+		}
+	}
+}
+
+func (b *MemoryBudget) release(size uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.used -= min(size, b.used)
+
+	close(b.released)
+	b.released = make(chan struct{})
+}
+
+// memoryLimitPages returns the pages allowed to each instance.
+func memoryLimitPages(limit uint64) uint32 {
+	if limit == 0 {
+		return maxMemoryPages
+	}
+
+	return uint32(max(1, min(limit/wasmPageSize, maxMemoryPages)))
+}
+
+// memoryReservation is the worst case memory of an instance of the module.
+func memoryReservation(o BuilderOptions, compiled wazero.CompiledModule) uint64 {
+	pages := memoryLimitPages(o.MemoryLimit)
+
+	for _, definition := range compiled.ExportedMemories() {
+		if declared, ok := definition.Max(); ok {
+			pages = min(pages, declared)
+		}
+	}
+
+	return uint64(pages) * wasmPageSize
+}
+
+// memoryBudget returns the budget of the handler, the process one by default.
+func (o BuilderOptions) memoryBudget() *MemoryBudget {
+	if o.MemoryBudget == nil {
+		return budget
+	}
+
+	return o.MemoryBudget
+}
+
+// budgetedInstance holds its memory reservation until it is closed.
+type budgetedInstance struct {
+	instance
+	budget *MemoryBudget
+	size   uint64
+}
+
+// withMemoryBudget reserves the memory of each instance before creating it.
+func withMemoryBudget(b *MemoryBudget, newInstance func(context.Context) (instance, error), size uint64) func(context.Context) (instance, error) {
+	return func(ctx context.Context) (instance, error) {
+		if err := b.acquire(ctx, size); err != nil {
+			return nil, err
+		}
+
+		i, err := newInstance(ctx)
+		if err != nil {
+			b.release(size)
+
+			return nil, err
+		}
+
+		return &budgetedInstance{instance: i, budget: b, size: size}, nil
+	}
+}
+
+func (b *budgetedInstance) Close(ctx context.Context) error {
+	defer b.budget.release(b.size)
+
+	return b.instance.Close(ctx)
+}
@@ -0,0 +1,115 @@
+package wazemmes
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMemoryBudget(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		limit    uint64
+		acquired []uint64
+		size     uint64
+		err      bool
+	}{
+		{name: "disabled", acquired: []uint64{1 << 40}, size: 1 << 40},
+		{name: "fits", limit: 10, acquired: []uint64{4}, size: 6},
+		{name: "exhausted", limit: 10, acquired: []uint64{4, 4}, size: 4, err: true},
+		{name: "larger than the budget", limit: 10, size: 11, err: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b := NewMemoryBudget(tc.limit, false)
+			for _, size := range tc.acquired {
+				if err := b.acquire(context.Background(), size); err != nil {
+					t.Fatalf("got the error %v", err)
+				}
+			}
+
+			err := b.acquire(context.Background(), tc.size)
+			if tc.err != errors.Is(err, ErrMemoryBudgetExhausted) {
+				t.Errorf("got the error %v", err)
+			}
+		})
+	}
+}
+
+func TestMemoryBudgetRelease(t *testing.T) {
+	b := NewMemoryBudget(10, false)
+	if err := b.acquire(context.Background(), 10); err != nil {
+		t.Fatalf("got the error %v", err)
+	}
+
+	b.release(10)
+	b.release(10)
+
+	if b.used != 0 {
+		t.Fatalf("%d bytes are still used", b.used)
+	}
+
+	if err := b.acquire(context.Background(), 10); err != nil {
+		t.Errorf("got the error %v once released", err)
+	}
+}
+
+func TestMemoryBudgetQueue(t *testing.T) {
+	b := NewMemoryBudget(10, true)
+	if err := b.acquire(context.Background(), 8); err != nil {
+		t.Fatalf("got the error %v", err)
+	}
+
+	if err := b.acquire(withoutQueue(context.Background()), 8); !errors.Is(err, ErrMemoryBudgetExhausted) {
+		t.Errorf("got the error %v without queue", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := b.acquire(ctx, 8); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got the error %v once the context is done", err)
+	}
+
+	acquired := make(chan error)
+	go func() {
+		acquired <- b.acquire(context.Background(), 8)
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	b.release(8)
+
+	if err := <-acquired; err != nil {
+		t.Errorf("got the error %v once released", err)
+	}
+}
+
+func TestMemoryBudgetScope(t *testing.T) {
+	options := BuilderOptions{Source: buildGuest(t, "cgi"), MemoryLimit: 6 << 20}
+
+	shared := NewMemoryBudget(10<<20, false)
+	options.MemoryBudget = shared
+
+	first, err := NewWasmHandlerWithOptions("cgi", options)
+	if err != nil {
+		t.Fatalf("got the error %v", err)
+	}
+
+	if _, err = NewWasmHandlerWithOptions("cgi", options); !errors.Is(err, ErrMemoryBudgetExhausted) {
+		t.Errorf("got the error %v in the exhausted budget", err)
+	}
+
+	options.MemoryBudget = NewMemoryBudget(10<<20, false)
+
+	second, err := NewWasmHandlerWithOptions("cgi", options)
+	if err != nil {
+		t.Fatalf("got the error %v in another budget", err)
+	}
+
+	_ = second.Close(context.Background())
+	_ = first.Close(context.Background())
+
+	if shared.used != 0 {
+		t.Errorf("%d bytes are still used once closed", shared.used)
+	}
+}
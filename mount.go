@@ -0,0 +1,134 @@
+package wazemmes
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/tetratelabs/wazero"
+)
+
+// Mount exposes a host directory to the guests at the guest path, the
+// guest path is the host one when empty.
+type Mount struct {
+	HostPath  string `json:"host_path"`
+	GuestPath string `json:"guest_path,omitempty"`
+	ReadOnly  bool   `json:"read_only,omitempty"`
+}
+
+// ParseMount parses a mount as host[:guest][:ro|:rw], it is read-only unless
+// rw is given.
+func ParseMount(value string) (Mount, error) {
+	parts := strings.Split(value, ":")
+	m := Mount{HostPath: parts[0], ReadOnly: true}
+
+	if last := parts[len(parts)-1]; len(parts) > 1 && (last == "ro" || last == "rw") {
+		m.ReadOnly = last == "ro"
+		parts = parts[:len(parts)-1]
+	}
+
+	switch len(parts) {
+	case 1:
+	case 2:
+		m.GuestPath = parts[1]
+	default:
+		return Mount{}, fmt.Errorf("invalid mount %q, expected host[:guest][:ro|:rw]", value)
+	}
+
+	if m.HostPath == "" {
+		return Mount{}, fmt.Errorf("invalid mount %q, the host path is empty", value)
+	}
+
+	return m, nil
+}
+
+func (m Mount) validate() error {
+	if m.HostPath == "" {
+		return fmt.Errorf("the mount of %q has no host path", m.GuestPath)
+	}
+
+	if info, err := os.Stat(m.HostPath); err != nil || !info.IsDir() {
+		return fmt.Errorf("the mount host path %s is not a directory", m.HostPath)
+	}
+
+	if m.GuestPath != "" && !path.IsAbs(m.GuestPath) {
+		return fmt.Errorf("the mount guest path %s is not absolute", m.GuestPath)
+	}
+
+	return nil
+}
+
+func (m Mount) guestPath() string {
+	if m.GuestPath != "" {
+		return path.Clean(m.GuestPath)
+	}
+
+	abs, err := filepath.Abs(m.HostPath)
+	if err != nil {
+		return filepath.ToSlash(m.HostPath)
+	}
+
+	return filepath.ToSlash(abs)
+}
+
+func (m Mount) apply(config wazero.FSConfig) wazero.FSConfig {
+	if m.ReadOnly {
+		return config.WithReadOnlyDirMount(m.HostPath, m.guestPath())
+	}
+
+	return config.WithDirMount(m.HostPath, m.guestPath())
+}
+
+// The guest paths of the php.ini and of the scratch directory of the php
+// instances.
+const (
+	phpIniDir  = "/etc/php"
+	phpIniPath = phpIniDir + "/php.ini"
+	phpTmpDir  = "/tmp"
+)
+
+// writePHPIni writes the php.ini of the guests in a new directory. The
+// scratch directory settings come first, then the content of the iniFile if
+// any and the directives, which override them.
+func writePHPIni(iniFile string, directives map[string]string) (string, error) {
+	var ini strings.Builder
+
+	fmt.Fprintf(&ini, "sys_temp_dir=%s\nupload_tmp_dir=%s\n", phpTmpDir, phpTmpDir)
+
+	if iniFile != "" {
+		content, err := os.ReadFile(iniFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read the php.ini: %w", err)
+		}
+
+		ini.Write(content)
+		ini.WriteString("\n")
+	}
+
+	keys := make([]string, 0, len(directives))
+	for key := range directives {
+		keys = append(keys, key)
+	}
+
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		fmt.Fprintf(&ini, "%s=%s\n", key, directives[key])
+	}
+
+	dir, err := os.MkdirTemp("", "wazemmes-php-ini-*")
+	if err != nil {
+		return "", err
+	}
+
+	if err = os.WriteFile(filepath.Join(dir, "php.ini"), []byte(ini.String()), 0o600); err != nil {
+		_ = os.RemoveAll(dir)
+
+		return "", err
+	}
+
+	return dir, nil
+}
@@ -0,0 +1,97 @@
+package wazemmes
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseMount(t *testing.T) {
+	for _, tc := range []struct {
+		value    string
+		expected Mount
+		err      bool
+	}{
+		{value: "/data", expected: Mount{HostPath: "/data", ReadOnly: true}},
+		{value: "/data:ro", expected: Mount{HostPath: "/data", ReadOnly: true}},
+		{value: "/data:rw", expected: Mount{HostPath: "/data"}},
+		{value: "/data:/mnt", expected: Mount{HostPath: "/data", GuestPath: "/mnt", ReadOnly: true}},
+		{value: "/data:/mnt:ro", expected: Mount{HostPath: "/data", GuestPath: "/mnt", ReadOnly: true}},
+		{value: "/data:/mnt:rw", expected: Mount{HostPath: "/data", GuestPath: "/mnt"}},
+		{value: "./data:rw", expected: Mount{HostPath: "./data"}},
+		{value: "/data:/rw", expected: Mount{HostPath: "/data", GuestPath: "/rw", ReadOnly: true}},
+		{value: "", err: true},
+		{value: ":/mnt", err: true},
+		{value: ":rw", err: true},
+		{value: "/data:/mnt:/other", err: true},
+		{value: "/data:/mnt:rw:ro", err: true},
+	} {
+		t.Run(tc.value, func(t *testing.T) {
+			m, err := ParseMount(tc.value)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("got the mount %+v, expected an error", m)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("got the error %v", err)
+			}
+
+			if m != tc.expected {
+				t.Errorf("got the mount %+v, expected %+v", m, tc.expected)
+			}
+		})
+	}
+}
+
+func TestMountValidate(t *testing.T) {
+	dir := t.TempDir()
+
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		mount Mount
+		err   string
+	}{
+		{name: "host path", mount: Mount{HostPath: dir}},
+		{name: "guest path", mount: Mount{HostPath: dir, GuestPath: "/mnt"}},
+		{name: "no host path", mount: Mount{GuestPath: "/mnt"}, err: "has no host path"},
+		{name: "missing host path", mount: Mount{HostPath: filepath.Join(dir, "missing")}, err: "is not a directory"},
+		{name: "file host path", mount: Mount{HostPath: file}, err: "is not a directory"},
+		{name: "relative guest path", mount: Mount{HostPath: dir, GuestPath: "mnt"}, err: "is not absolute"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.mount.validate()
+			if tc.err == "" && err != nil {
+				t.Fatalf("got the error %v", err)
+			}
+
+			if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+				t.Fatalf("got the error %v, expected %q", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestMountGuestPath(t *testing.T) {
+	if got := (Mount{HostPath: "/data", GuestPath: "/mnt/../srv/"}).guestPath(); got != "/srv" {
+		t.Errorf("got the guest path %s, expected /srv", got)
+	}
+
+	abs, err := filepath.Abs("data")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := (Mount{HostPath: "data"}).guestPath(); got != filepath.ToSlash(abs) {
+		t.Errorf("got the guest path %s, expected %s", got, filepath.ToSlash(abs))
+	}
+}
@@ -1,148 +1,258 @@
 package wazemmes
 
 import (
-	"bytes"
 	"context"
 	_ "embed"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"net/http"
 	"os"
-	"strings"
+	"slices"
 
 	"github.com/tetratelabs/wazero"
-	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
 	"go.uber.org/zap"
 )
 
 type phpWASMHandler struct {
-	runtime        wazero.Runtime
+	cgiRunner
 	compiledModule wazero.CompiledModule
 	documentRoot   string
+	// root routes the requests to the scripts of a document root, the
+	// source script runs for every request without it.
+	root *docRoot
+	// mounts replace the parent of the working directory mounted at / by
+	// default, iniDir holds the php.ini of the guests.
+	mounts []Mount
+	iniDir string
 }
 
-func (h *phpWASMHandler) getScriptPath(urlPath string) string {
-	if urlPath == "/" || urlPath == "" {
-		return "index.php"
+// moduleConfig mounts the document root, the configured mounts, the php.ini
+// and the scratch directory of the instance at /tmp.
+func (h *phpWASMHandler) moduleConfig(tmpDir string) wazero.ModuleConfig {
+	fsConfig := wazero.NewFSConfig()
+
+	if h.root == nil && len(h.mounts) == 0 {
+		fsConfig = fsConfig.WithFSMount(os.DirFS(".."), "/")
 	}
 
-	return h.documentRoot
-}
+	if h.root != nil && !slices.ContainsFunc(h.mounts, func(m Mount) bool { return m.guestPath() == h.root.guestDir() }) {
+		fsConfig = fsConfig.WithReadOnlyDirMount(h.root.dir, h.root.guestDir())
+	}
 
-func (h *phpWASMHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) error {
-	scriptPath := h.getScriptPath(r.URL.Path)
+	for _, m := range h.mounts {
+		fsConfig = m.apply(fsConfig)
+	}
 
-	// Create a pipe to capture PHP output
-	outputBuffer := &strings.Builder{}
+	fsConfig = fsConfig.
+		WithReadOnlyDirMount(h.iniDir, phpIniDir).
+		WithDirMount(tmpDir, phpTmpDir)
 
-	// Configure module with CGI environment
-	config := wazero.NewModuleConfig().
-		WithStdout(outputBuffer).
+	return wazero.NewModuleConfig().
 		WithStderr(os.Stderr).
-		WithFS(os.DirFS("..")).
-		WithArgs("php-cgi", scriptPath).
-		WithEnv("REQUEST_METHOD", r.Method).
-		WithEnv("REQUEST_URI", r.RequestURI).
-		WithEnv("SCRIPT_FILENAME", scriptPath).
-		WithEnv("SCRIPT_NAME", scriptPath).
-		WithEnv("DOCUMENT_ROOT", h.documentRoot).
-		WithEnv("QUERY_STRING", r.URL.RawQuery).
-		WithEnv("CONTENT_TYPE", r.Header.Get("Content-Type")).
-		WithEnv("CONTENT_LENGTH", r.Header.Get("Content-Length")).
-		WithEnv("SERVER_SOFTWARE", "Go-WASM-Server/1.0").
-		WithEnv("SERVER_NAME", r.Host).
-		WithEnv("SERVER_PORT", "8080").
-		WithEnv("GATEWAY_INTERFACE", "CGI/1.1").
-		WithEnv("SERVER_PROTOCOL", r.Proto).
-		WithEnv("HTTP_HOST", r.Host).
-		WithEnv("HTTP_USER_AGENT", r.Header.Get("User-Agent")).
-		WithEnv("HTTP_ACCEPT", r.Header.Get("Accept")).
-		WithEnv("HTTP_ACCEPT_LANGUAGE", r.Header.Get("Accept-Language")).
-		WithEnv("HTTP_ACCEPT_ENCODING", r.Header.Get("Accept-Encoding")).
-		WithEnv("HTTP_CONNECTION", r.Header.Get("Connection"))
-
-	// Add custom headers as HTTP_* environment variables
-	for key, values := range r.Header {
-		if len(values) > 0 {
-			envKey := fmt.Sprintf("HTTP_%s", strings.ToUpper(strings.ReplaceAll(key, "-", "_")))
-			config = config.WithEnv(envKey, values[0])
-		}
+		WithFSConfig(fsConfig)
+}
+
+// route returns the script of the URL path, and false when no script
+// matches.
+func (h *phpWASMHandler) route(urlPath string) (script, bool) {
+	if h.root != nil {
+		return h.root.resolve(urlPath)
 	}
 
-	// If there's a request body, we need to handle it
-	if r.Body != nil {
-		stdin := bytes.NewBuffer([]byte{})
+	name := h.documentRoot
+	if urlPath == "/" || urlPath == "" {
+		name = "index.php"
+	}
 
-		_, err := io.Copy(stdin, r.Body)
-		if err != nil {
-			return err
-		}
+	return script{name: name, filename: name}, true
+}
+
+func (h *phpWASMHandler) guestDocumentRoot() string {
+	if h.root != nil {
+		return h.root.guestDir()
+	}
+
+	return h.documentRoot
+}
 
-		r.Body = io.NopCloser(bytes.NewReader(stdin.Bytes()))
+// phpInstance keeps php-cgi instantiated ahead of the next request, with the
+// scratch directory of the slot mounted. The CGI environment is given when
+// it runs.
+type phpInstance struct {
+	*guestSlots
+	handler *phpWASMHandler
+	tmpDir  string
+}
 
-		config.WithStdin(stdin)
+func (h *phpWASMHandler) newInstance(ctx context.Context) (instance, error) {
+	tmpDir, err := os.MkdirTemp("", "wazemmes-php-tmp-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the scratch directory: %w", err)
 	}
 
-	module, _ := h.runtime.InstantiateModule(r.Context(), h.compiledModule, config)
+	slots, err := newGuestSlots(ctx, 1, func(ctx context.Context, _ int) (*guestModule, error) {
+		return instantiateGuest(ctx, h.runtime, h.compiledModule, h.moduleConfig(tmpDir), nil)
+	})
+	if err != nil {
+		_ = os.RemoveAll(tmpDir)
 
-	defer func() {
-		_ = module.Close(r.Context())
-	}()
+		return nil, fmt.Errorf("failed to instantiate WASM module: %w", err)
+	}
 
-	var response baseHandler
-	_ = json.NewDecoder(bytes.NewReader([]byte(strings.Split(outputBuffer.String(), "\r\n\r\n")[1]))).Decode(&response)
+	return &phpInstance{guestSlots: slots, handler: h, tmpDir: tmpDir}, nil
+}
 
-	if response.Error != "" {
-		rw.WriteHeader(http.StatusInternalServerError)
-		_, _ = rw.Write([]byte(response.Error))
+func (i *phpInstance) NewHandler(_ context.Context, next Handler) Handler {
+	return HandlerFunc(func(rw http.ResponseWriter, req *http.Request) error {
+		return i.handler.serve(rw, req, next, i)
+	})
+}
 
-		rw.(http.Flusher).Flush()
+func (i *phpInstance) Close(ctx context.Context) error {
+	return errors.Join(i.guestSlots.Close(ctx), os.RemoveAll(i.tmpDir))
+}
 
-		return errors.New(response.Error)
+// ServeHTTP runs the script, outside of any pool.
+func (h *phpWASMHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) error {
+	i, err := h.newInstance(r.Context())
+	if err != nil {
+		return err
 	}
 
-	for key, values := range response.Response.Headers {
-		for _, value := range values {
-			rw.Header().Set(key, value)
-		}
-	}
+	defer func() {
+		_ = i.Close(r.Context())
+	}()
+
+	return i.NewHandler(r.Context(), nil).ServeHTTP(rw, r)
+}
+
+// serve runs the script of the request, see cgiRunner.serve.
+func (h *phpWASMHandler) serve(rw http.ResponseWriter, r *http.Request, next Handler, i *phpInstance) error {
+	return h.cgiRunner.serve(rw, r, next, func(r *http.Request) (cgiRun, bool) {
+		target, ok := h.route(r.URL.Path)
 
-	_, _ = rw.Write([]byte(response.Response.Body))
+		return cgiRun{
+			take: func(ctx context.Context) (*guestModule, error) {
+				return i.take(ctx, 0)
+			},
+			args: []string{"php-cgi", "-c", phpIniPath, target.filename},
+			env: func(contentLength int64) map[string]string {
+				env := cgiEnv(r, cgiRequest{
+					script:        target,
+					documentRoot:  h.guestDocumentRoot(),
+					contentLength: contentLength,
+				})
+				// php-cgi refuses to run without it when cgi.force_redirect is on.
+				env["REDIRECT_STATUS"] = "200"
+				env["TMPDIR"] = phpTmpDir
 
-	return nil
+				return env
+			},
+		}, ok
+	})
 }
 
 //go:embed php-cgi.wasm
 var phpWasm []byte
 
-func NewWasmHandlerPHP(modulepath string, _ any, poolConfiguration map[string]interface{},
+var phpSource = NewBytesSource("php-cgi.wasm", phpWasm)
+
+func NewWasmHandlerPHP(modulepath string, moduleConfig any, poolConfiguration map[string]interface{},
 	logger *zap.Logger) (*WasmHandler, error) {
+	return newWasmHandlerPHP(BuilderOptions{
+		Source:        NewFileSource(modulepath),
+		Configuration: moduleConfig,
+		Pool:          poolConfiguration,
+		Logger:        logger,
+	})
+}
+
+// newWasmHandlerPHP runs the configured interpreter or the embedded one, the
+// source name is the script path. The source is optional with a document
+// root. The interpreters are compiled once through
+// the shared compilation cache.
+func newWasmHandlerPHP(o BuilderOptions) (_ *WasmHandler, err error) {
 	ctx := context.Background()
 
-	runtime := wazero.NewRuntime(ctx)
+	if o.Source == nil && o.DocumentRoot == "" {
+		return nil, errors.New("the php builder needs a script or a document root")
+	}
 
-	if _, err := wasi_snapshot_preview1.Instantiate(ctx, runtime); err != nil {
-		return nil, fmt.Errorf("failed to instantiate WASI: %w", err)
+	// php-cgi is a WASI command, it only exports _start.
+	if o.Snapshot != nil {
+		return nil, errors.New("the php builder doesn't support the snapshots, php-cgi is a WASI command without init export")
 	}
 
-	compiled, err := runtime.CompileModule(ctx, phpWasm)
+	runtime, err := newCGIRuntime(ctx, o)
 	if err != nil {
-		return nil, fmt.Errorf("failed to compile WASM module: %w", err)
+		return nil, err
+	}
+
+	defer func() {
+		if err != nil {
+			_ = runtime.Close(ctx)
+		}
+	}()
+
+	interpreter := o.Interpreter
+	if interpreter == nil {
+		interpreter = phpSource
+	}
+
+	code, err := interpreter.Bytes()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the PHP interpreter %s: %w", interpreter.Name(), err)
+	}
+
+	compiled, err := runtime.CompileModule(ctx, code)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile the PHP interpreter %s: %w", interpreter.Name(), err)
 	}
 
 	wasmHandlerPHP := &phpWASMHandler{
-		runtime:        runtime,
+		cgiRunner:      newCGIRunner(runtime, o),
 		compiledModule: compiled,
-		documentRoot:   modulepath,
+		mounts:         o.Mounts,
+	}
+
+	if o.Source != nil {
+		wasmHandlerPHP.documentRoot = o.Source.Name()
 	}
 
-	return NewWasmHandlerInstance(
-		func(ctx context.Context, next Handler) Handler {
-			return wasmHandlerPHP
-		},
-		poolConfiguration,
-		logger,
-	)
+	for _, m := range o.Mounts {
+		if err = m.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	wasmHandlerPHP.iniDir, err = writePHPIni(o.PHPIni, o.PHPIniDirectives)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err != nil {
+			_ = os.RemoveAll(wasmHandlerPHP.iniDir)
+		}
+	}()
+
+	if o.DocumentRoot != "" {
+		wasmHandlerPHP.root, err = newDocRoot(o.DocumentRoot, ".php", o.IndexFiles, o.FrontController)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	w, err := newWasmHandler(withMemoryBudget(o.memoryBudget(), wasmHandlerPHP.newInstance, memoryReservation(o, compiled)), o.Pool, o.Logger)
+	if err != nil {
+		return nil, err
+	}
+
+	w.script = o.Source
+	w.onClose(runtime.Close)
+	w.onClose(func(context.Context) error {
+		return os.RemoveAll(wasmHandlerPHP.iniDir)
+	})
+
+	return w, nil
 }
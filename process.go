@@ -0,0 +1,120 @@
+package wazemmes
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// The WASI errno values returned by the process functions.
+const (
+	errnoSuccess = 0
+	errnoFault   = 21
+)
+
+type processKey struct{}
+
+// process is the command line and the environment of a guest run. WASI binds
+// them at instantiation, the CGI modules get them when they run so they can
+// be instantiated ahead of their request.
+type process struct {
+	args []string
+	env  []string
+}
+
+// withProcess returns the context a guest runs with the args and env in, the
+// variables are sorted.
+func withProcess(ctx context.Context, args []string, env map[string]string) context.Context {
+	p := process{args: args, env: make([]string, 0, len(env))}
+
+	for key, value := range env {
+		p.env = append(p.env, key+"="+value)
+	}
+
+	slices.Sort(p.env)
+
+	return context.WithValue(ctx, processKey{}, p)
+}
+
+// processOf returns the process of the context, empty outside of a run.
+func processOf(ctx context.Context) process {
+	p, _ := ctx.Value(processKey{}).(process)
+
+	return p
+}
+
+// newCGIRuntime creates a runtime with WASI preview 1 instantiated, its args
+// and environ functions read the process of the running call, see
+// withProcess.
+func newCGIRuntime(ctx context.Context, o BuilderOptions) (wazero.Runtime, error) {
+	config, err := newRuntimeConfig(o)
+	if err != nil {
+		return nil, err
+	}
+
+	runtime := wazero.NewRuntimeWithConfig(ctx, config)
+
+	builder := runtime.NewHostModuleBuilder(wasi_snapshot_preview1.ModuleName)
+	wasi_snapshot_preview1.NewFunctionExporter().ExportFunctions(builder)
+	exportStrings(builder, "args", func(p process) []string { return p.args })
+	exportStrings(builder, "environ", func(p process) []string { return p.env })
+
+	if _, err = builder.Instantiate(ctx); err != nil {
+		_ = runtime.Close(ctx)
+
+		return nil, fmt.Errorf("failed to instantiate WASI: %w", err)
+	}
+
+	return runtime, nil
+}
+
+// exportStrings replaces the <prefix>_sizes_get and <prefix>_get functions
+// of WASI with the strings of the running process.
+func exportStrings(builder wazero.HostModuleBuilder, prefix string, strings func(process) []string) {
+	i32 := api.ValueTypeI32
+
+	builder.NewFunctionBuilder().
+		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+			values := strings(processOf(ctx))
+
+			size := 0
+			for _, value := range values {
+				size += len(value) + 1
+			}
+
+			memory := mod.Memory()
+			if !memory.WriteUint32Le(uint32(stack[0]), uint32(len(values))) || !memory.WriteUint32Le(uint32(stack[1]), uint32(size)) {
+				stack[0] = errnoFault
+
+				return
+			}
+
+			stack[0] = errnoSuccess
+		}), []api.ValueType{i32, i32}, []api.ValueType{i32}).
+		WithParameterNames("result.count", "result.size").
+		Export(prefix + "_sizes_get")
+
+	builder.NewFunctionBuilder().
+		WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, mod api.Module, stack []uint64) {
+			offsets, buf := uint32(stack[0]), uint32(stack[1])
+			memory := mod.Memory()
+
+			for i, value := range strings(processOf(ctx)) {
+				if !memory.WriteUint32Le(offsets+uint32(4*i), buf) || !memory.WriteString(buf, value) || !memory.WriteByte(buf+uint32(len(value)), 0) {
+					stack[0] = errnoFault
+
+					return
+				}
+
+				buf += uint32(len(value)) + 1
+			}
+
+			stack[0] = errnoSuccess
+		}), []api.ValueType{i32, i32}, []api.ValueType{i32}).
+		WithParameterNames("offsets", "buf").
+		Export(prefix + "_get")
+}
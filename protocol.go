@@ -0,0 +1,83 @@
+package wazemmes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// The versions of the JSON protocol spoken with the guests on their stdio.
+//
+// The version 1 is the legacy one, the request URL is a marshaled url.URL
+// object. The version 2 carries the URL as a string.
+const (
+	ProtocolV1 = 1
+	ProtocolV2 = 2
+	// ProtocolVersion is the latest version supported by the host.
+	ProtocolVersion = ProtocolV2
+)
+
+// HandshakeContext is the context of the input sent once when the module is
+// built, its version is the one of the host. The guest answers with the
+// version it speaks, the guests which don't answer speak the version 1.
+const HandshakeContext = "handshake"
+
+// handshakeTimeout bounds the handshake of the guests that never return.
+const handshakeTimeout = 5 * time.Second
+
+// negotiate runs the handshake with a fresh guest instance.
+func (h *JSWASMHandler) negotiate(ctx context.Context) int {
+	ctx, cancel := context.WithTimeout(ctx, handshakeTimeout)
+	defer cancel()
+
+	output, err := h.invoke(ctx, h.instantiate, Input{Context: HandshakeContext, Version: ProtocolVersion}, nil, nil)
+	if err != nil || output.Version < ProtocolV1 {
+		return ProtocolV1
+	}
+
+	return min(output.Version, ProtocolVersion)
+}
+
+// marshalURL encodes the URL the way the protocol version expects it.
+func marshalURL(u *url.URL, version int) any {
+	if version < ProtocolV2 || u == nil {
+		return u
+	}
+
+	return u.String()
+}
+
+// unmarshalURL accepts the URL as a string or as an object whatever the
+// version, the omitted fields of an object keep the value of the current URL.
+func unmarshalURL(data json.RawMessage, current *url.URL) (*url.URL, error) {
+	if len(data) == 0 || string(data) == "null" {
+		return current, nil
+	}
+
+	if data[0] == '"' {
+		var raw string
+		if err := json.Unmarshal(data, &raw); err != nil {
+			return nil, err
+		}
+
+		u, err := url.Parse(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid guest URL: %w", err)
+		}
+
+		return u, nil
+	}
+
+	var u url.URL
+	if current != nil {
+		u = *current
+	}
+
+	if err := json.Unmarshal(data, &u); err != nil {
+		return nil, err
+	}
+
+	return &u, nil
+}
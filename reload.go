@@ -0,0 +1,118 @@
+package wazemmes
+
+import (
+	"context"
+	"io/fs"
+	"strings"
+	"time"
+)
+
+const reloadInterval = 2 * time.Second
+
+// watched is a module file polled for changes.
+type watched struct {
+	source ModuleSource
+	stat   func() (fs.FileInfo, error)
+	info   fs.FileInfo
+}
+
+// changed tells whether the file changed since the previous poll. A file
+// failing to stat may be in the middle of being replaced, it is checked again
+// on the next poll.
+func (f *watched) changed() bool {
+	current, err := f.stat()
+	if err != nil || current.ModTime().Equal(f.info.ModTime()) && current.Size() == f.info.Size() {
+		return false
+	}
+
+	f.info = current
+
+	return true
+}
+
+// watchedFiles returns the module files to poll. Directories, unreadable
+// paths, the sources that are not backed by a file and the script run by an
+// interpreter are not watched.
+func (w *WasmHandler) watchedFiles(sources []ModuleSource) []*watched {
+	files := make([]*watched, 0, len(sources))
+
+	for _, source := range sources {
+		statter, ok := source.(statSource)
+		if !ok || source == w.script {
+			continue
+		}
+
+		info, err := statter.stat()
+		if err != nil || info.IsDir() {
+			continue
+		}
+
+		files = append(files, &watched{source: source, stat: statter.stat, info: info})
+	}
+
+	return files
+}
+
+// watch polls the module files and rebuilds the handler in the background
+// each time one of them changes on disk, see watchedFiles.
+func (w *WasmHandler) watch(sources []ModuleSource, build func() (*WasmHandler, error)) {
+	files := w.watchedFiles(sources)
+	if len(files) == 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(reloadInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-w.done:
+				return
+			case <-ticker.C:
+			}
+
+			changed := make([]string, 0, len(files))
+
+			for _, file := range files {
+				if file.changed() {
+					changed = append(changed, file.source.Name())
+				}
+			}
+
+			if len(changed) > 0 {
+				w.reload(strings.Join(changed, ", "), build)
+			}
+		}
+	}()
+}
+
+// reload builds a fresh handler and swaps its generation in place of the
+// current one. When the build fails, the previous version keeps serving
+// requests.
+func (w *WasmHandler) reload(modulepath string, build func() (*WasmHandler, error)) {
+	fresh, err := build()
+	if err != nil {
+		w.logger.Sugar().Errorf("impossible to reload the module %s, keeping the previous version: %v", modulepath, err)
+
+		return
+	}
+
+	previous := w.generation.Load()
+	if previous == nil || !w.generation.CompareAndSwap(previous, fresh.generation.Load()) {
+		// The handler was closed in the meantime.
+		_ = fresh.Close(context.Background())
+
+		return
+	}
+
+	// The previous generation is released once its in-flight requests finish
+	// on the previous instances.
+	go func() {
+		if err := previous.close(context.Background()); err != nil {
+			w.logger.Sugar().Errorf("impossible to release the previous version of the module %s: %v", modulepath, err)
+		}
+	}()
+
+	w.logger.Sugar().Infof("module %s reloaded", modulepath)
+}
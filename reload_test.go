@@ -0,0 +1,235 @@
+package wazemmes
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// copyGuest copies the test guest, so the test can touch it.
+func copyGuest(t *testing.T, name string) string {
+	t.Helper()
+
+	code, err := buildGuest(t, name).Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), name+".wasm")
+	if err = os.WriteFile(path, code, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// touch changes the modification time of the file, as a new build would.
+func touch(t *testing.T, path string) {
+	t.Helper()
+
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// reloaded waits for the handler to replace the previous generation, a few
+// polls at most.
+func reloaded(h *WasmHandler, previous *generation) bool {
+	for deadline := time.Now().Add(3 * reloadInterval); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		if h.generation.Load() != previous {
+			return true
+		}
+	}
+
+	return false
+}
+
+// newReloadedHandler builds a cgi handler of the copied cgi guest.
+func newReloadedHandler(t *testing.T, options BuilderOptions) (*WasmHandler, string) {
+	t.Helper()
+
+	path := copyGuest(t, "cgi")
+	options.Source = NewFileSource(path)
+
+	if options.Logger == nil {
+		options.Logger = zap.NewNop()
+	}
+
+	h, err := NewWasmHandlerWithOptions("cgi", options)
+	if err != nil {
+		t.Fatalf("impossible to build the handler: %v", err)
+	}
+
+	t.Cleanup(func() {
+		_ = h.Close(context.Background())
+	})
+
+	return h, path
+}
+
+func TestReloadWatchesEverySource(t *testing.T) {
+	tests := map[string]func(path string) (string, BuilderOptions){
+		"filepath": func(path string) (string, BuilderOptions) {
+			return "cgi", BuilderOptions{Source: NewFileSource(path)}
+		},
+		"interpreter": func(path string) (string, BuilderOptions) {
+			return "php", BuilderOptions{Source: NewFileSource("index.php"), Interpreter: NewSharedFileSource(path)}
+		},
+		"route": func(path string) (string, BuilderOptions) {
+			return "cgi", BuilderOptions{Routes: []Route{{Path: "/api/...", Source: NewFileSource(path)}}}
+		},
+	}
+
+	for name, options := range tests {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			path := copyGuest(t, "cgi")
+			builder, o := options(path)
+			o.Logger = zap.NewNop()
+
+			h, err := NewWasmHandlerWithOptions(builder, o)
+			if err != nil {
+				t.Fatalf("impossible to build the handler: %v", err)
+			}
+
+			defer func() {
+				_ = h.Close(context.Background())
+			}()
+
+			previous := h.generation.Load()
+			touch(t, path)
+
+			if !reloaded(h, previous) {
+				t.Fatalf("the handler wasn't reloaded after the %s changed", name)
+			}
+		})
+	}
+}
+
+func TestReloadSkipsThePHPScripts(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "index.php")
+	if err := os.WriteFile(script, []byte("<?php echo 'ok';"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, builder := range []string{"php", AutoBuilder} {
+		t.Run(builder, func(t *testing.T) {
+			interpreter := copyGuest(t, "cgi")
+			o := BuilderOptions{Source: NewFileSource(script), Interpreter: NewFileSource(interpreter), Logger: zap.NewNop()}
+
+			h, err := NewWasmHandlerWithOptions(builder, o)
+			if err != nil {
+				t.Fatalf("impossible to build the handler: %v", err)
+			}
+
+			defer func() {
+				_ = h.Close(context.Background())
+			}()
+
+			files := h.watchedFiles(o.sources())
+			if len(files) != 1 || files[0].source.Name() != interpreter {
+				t.Errorf("got %d watched files, expected the interpreter only", len(files))
+			}
+		})
+	}
+}
+
+func TestReloadDisabled(t *testing.T) {
+	t.Parallel()
+
+	h, path := newReloadedHandler(t, BuilderOptions{DisableReload: true})
+
+	previous := h.generation.Load()
+	touch(t, path)
+	time.Sleep(reloadInterval + 500*time.Millisecond)
+
+	if h.generation.Load() != previous {
+		t.Error("the handler was reloaded with the reload disabled")
+	}
+}
+
+func TestReloadKeepsThePreviousGeneration(t *testing.T) {
+	t.Parallel()
+
+	core, logs := observer.New(zap.ErrorLevel)
+	h, path := newReloadedHandler(t, BuilderOptions{Logger: zap.New(core)})
+
+	previous := h.generation.Load()
+	if err := os.WriteFile(path, []byte("not a module"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	touch(t, path)
+
+	for deadline := time.Now().Add(3 * reloadInterval); logs.FilterMessageSnippet("impossible to reload").Len() == 0; time.Sleep(100 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the failed reload wasn't logged")
+		}
+	}
+
+	if h.generation.Load() != previous {
+		t.Error("the generation was replaced by a module failing to compile")
+	}
+
+	rec := httptest.NewRecorder()
+	if err := BuildMiddlewareChain(zap.NewNop(), []*WasmHandler{h}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil)); err != nil || rec.Code != http.StatusOK {
+		t.Errorf("got the status %d and the error %v from the previous generation", rec.Code, err)
+	}
+}
+
+func TestReloadInFlightRequests(t *testing.T) {
+	t.Parallel()
+
+	h, path := newReloadedHandler(t, BuilderOptions{})
+
+	entered, release := make(chan struct{}), make(chan struct{})
+	next := HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) error {
+		close(entered)
+		<-release
+		rw.WriteHeader(http.StatusAccepted)
+
+		return nil
+	})
+
+	previous := h.generation.Load()
+	rec := httptest.NewRecorder()
+	done := make(chan error, 1)
+
+	// The /continue request keeps its instance of the previous generation
+	// while the next handler runs.
+	go func() {
+		done <- BuildMiddlewareChainWithNext(zap.NewNop(), []*WasmHandler{h}, next).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/continue", nil))
+	}()
+
+	<-entered
+	touch(t, path)
+
+	if !reloaded(h, previous) {
+		t.Fatal("the handler wasn't reloaded")
+	}
+
+	if previous.pool.IsClosed() {
+		t.Error("the previous generation was released during an in-flight request")
+	}
+
+	close(release)
+
+	if err := <-done; err != nil || rec.Code != http.StatusAccepted || rec.Header().Get("X-Guest") != "continued" {
+		t.Errorf("got the status %d, the headers %v and the error %v", rec.Code, rec.Header(), err)
+	}
+
+	for deadline := time.Now().Add(time.Second); !previous.pool.IsClosed(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the previous generation wasn't released after its last request")
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package wazemmes
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+var (
+	cachesMu sync.Mutex
+	caches   = map[string]wazero.CompilationCache{}
+)
+
+// compilationCache returns the cache shared by every builder for the given
+// directory, or the shared in-memory one when dir is empty. The entries are
+// keyed by the module hash, so a restart or a configuration reload doesn't
+// compile the same module again.
+func compilationCache(dir string) (wazero.CompilationCache, error) {
+	cachesMu.Lock()
+	defer cachesMu.Unlock()
+
+	if cache, ok := caches[dir]; ok {
+		return cache, nil
+	}
+
+	cache := wazero.NewCompilationCache()
+	if dir != "" {
+		var err error
+
+		cache, err = wazero.NewCompilationCacheWithDir(dir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open the compilation cache %s: %w", dir, err)
+		}
+	}
+
+	caches[dir] = cache
+
+	return cache, nil
+}
+
+// newRuntimeConfig returns the runtime configuration shared by the builders,
+// the guests are closed as soon as their context is done and their memory is
+// bounded by the limit.
+func newRuntimeConfig(o BuilderOptions) (wazero.RuntimeConfig, error) {
+	cache, err := compilationCache(o.CacheDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return wazero.NewRuntimeConfig().
+		WithCompilationCache(cache).
+		WithCloseOnContextDone(true).
+		WithMemoryLimitPages(memoryLimitPages(o.MemoryLimit)), nil
+}
+
+// newWASIRuntime creates a runtime with WASI preview 1 instantiated.
+func newWASIRuntime(ctx context.Context, o BuilderOptions) (wazero.Runtime, error) {
+	config, err := newRuntimeConfig(o)
+	if err != nil {
+		return nil, err
+	}
+
+	runtime := wazero.NewRuntimeWithConfig(ctx, config)
+
+	if _, err = wasi_snapshot_preview1.Instantiate(ctx, runtime); err != nil {
+		_ = runtime.Close(ctx)
+
+		return nil, fmt.Errorf("failed to instantiate WASI: %w", err)
+	}
+
+	return runtime, nil
+}
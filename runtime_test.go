@@ -0,0 +1,116 @@
+package wazemmes
+
+import (
+	"context"
+	"io/fs"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// cachedFiles returns the modification time of each file of the cache.
+func cachedFiles(t *testing.T, dir string) map[string]time.Time {
+	t.Helper()
+
+	files := map[string]time.Time{}
+
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		files[path] = info.ModTime()
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return files
+}
+
+func TestCompilationCacheDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "cache")
+	source := buildGuest(t, "cgi")
+
+	build := func() {
+		t.Helper()
+
+		h, err := NewWasmHandlerWithOptions("cgi", BuilderOptions{Source: source, CacheDir: dir, Logger: zap.NewNop()})
+		if err != nil {
+			t.Fatalf("impossible to build the handler: %v", err)
+		}
+
+		_ = h.Close(context.Background())
+	}
+
+	t.Cleanup(func() {
+		cachesMu.Lock()
+		delete(caches, dir)
+		cachesMu.Unlock()
+	})
+
+	// The directory is created with the compiled module.
+	build()
+
+	compiled := cachedFiles(t, dir)
+	if len(compiled) == 0 {
+		t.Fatalf("the compiled module wasn't written in %s", dir)
+	}
+
+	// The next builds reuse the compiled module, including a restart
+	// reopening the directory.
+	build()
+
+	cachesMu.Lock()
+	delete(caches, dir)
+	cachesMu.Unlock()
+
+	build()
+
+	reused := cachedFiles(t, dir)
+	if len(reused) != len(compiled) {
+		t.Errorf("got %d cached files, expected %d", len(reused), len(compiled))
+	}
+
+	for path, modTime := range compiled {
+		if !reused[path].Equal(modTime) {
+			t.Errorf("the cached file %s was written again", path)
+		}
+	}
+}
+
+func TestCompilationCacheInMemory(t *testing.T) {
+	cache, err := compilationCache("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shared, err := compilationCache("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cache != shared {
+		t.Error("the builders without cache directory don't share the in-memory cache")
+	}
+
+	dir := t.TempDir()
+	t.Cleanup(func() {
+		cachesMu.Lock()
+		delete(caches, dir)
+		cachesMu.Unlock()
+	})
+
+	if onDisk, err := compilationCache(dir); err != nil || onDisk == cache {
+		t.Errorf("got the error %v, expected a cache distinct from the in-memory one", err)
+	}
+}
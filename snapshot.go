@@ -0,0 +1,144 @@
+package wazemmes
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+)
+
+const (
+	defaultSnapshotInit  = "_initialize"
+	defaultSnapshotEntry = "_start"
+
+	wasmPageSize = 65536
+)
+
+// SnapshotConfiguration enables the snapshot mode of the js builder. The
+// module is initialized once up to its ready point, then each instance
+// restores the captured linear memory and exported mutable globals instead of
+// booting the guest again.
+//
+// The module must export Init and Entry, the WASI command modules only export
+// _start and are rejected. The stack pointer is not exported by most
+// toolchains, it is expected to be back to its initial value once Init
+// returns.
+type SnapshotConfiguration struct {
+	// Init is called once to reach the ready point, _initialize by default.
+	Init string `json:"init,omitempty"`
+	// Entry is called to handle each request, _start by default.
+	Entry string `json:"entry,omitempty"`
+}
+
+func (c SnapshotConfiguration) init() string {
+	if c.Init == "" {
+		return defaultSnapshotInit
+	}
+
+	return c.Init
+}
+
+func (c SnapshotConfiguration) entry() string {
+	if c.Entry == "" {
+		return defaultSnapshotEntry
+	}
+
+	return c.Entry
+}
+
+type snapshot struct {
+	entry   string
+	memory  []byte
+	globals map[string]uint64
+}
+
+// validate checks the module exports the init and the entry, the command
+// modules only export _start.
+func (c SnapshotConfiguration) validate(module moduleInterface) error {
+	if !module.exportsFunction(c.init()) {
+		return fmt.Errorf("the module doesn't export the snapshot init %s: export it, or pre-initialize the module with wizer and keep its init", c.init())
+	}
+
+	if !module.exportsFunction(c.entry()) {
+		return fmt.Errorf("the module doesn't export the snapshot entry %s", c.entry())
+	}
+
+	return nil
+}
+
+// takeSnapshot initializes the module and captures its state.
+func takeSnapshot(ctx context.Context, runtime wazero.Runtime, compiled wazero.CompiledModule, code []byte, config wazero.ModuleConfig, configuration SnapshotConfiguration) (*snapshot, error) {
+	definition, err := inspectModule(code)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the module exports: %w", err)
+	}
+
+	if err = configuration.validate(definition); err != nil {
+		return nil, err
+	}
+
+	module, err := runtime.InstantiateModule(ctx, compiled, config.WithName("").WithStartFunctions())
+	if err != nil {
+		return nil, fmt.Errorf("failed to instantiate WASM module: %w", err)
+	}
+
+	defer func() {
+		_ = module.Close(ctx)
+	}()
+
+	if _, err = module.ExportedFunction(configuration.init()).Call(ctx); err != nil {
+		return nil, fmt.Errorf("failed to initialize the snapshot: %w", err)
+	}
+
+	memory := module.Memory()
+	if memory == nil {
+		return nil, errors.New("the module doesn't have a memory to snapshot")
+	}
+
+	pages, _ := memory.Grow(0)
+	data, _ := memory.Read(0, pages*wasmPageSize)
+
+	s := &snapshot{
+		entry:   configuration.entry(),
+		memory:  bytes.Clone(data),
+		globals: make(map[string]uint64),
+	}
+
+	for name, kind := range definition.exports {
+		if global, ok := module.ExportedGlobal(name).(api.MutableGlobal); kind == externGlobal && ok {
+			s.globals[name] = global.Get()
+		}
+	}
+
+	return s, nil
+}
+
+// restore writes the captured state into a freshly instantiated module.
+func (s *snapshot) restore(module api.Module) error {
+	memory := module.Memory()
+	if memory == nil {
+		return errors.New("the module doesn't have a memory to restore")
+	}
+
+	pages := uint32(len(s.memory) / wasmPageSize)
+	if current, _ := memory.Grow(0); current < pages {
+		if _, ok := memory.Grow(pages - current); !ok {
+			return errors.New("impossible to grow the memory to the snapshot size")
+		}
+	}
+
+	if !memory.Write(0, s.memory) {
+		return errors.New("impossible to write the snapshot memory")
+	}
+
+	for name, value := range s.globals {
+		if global, ok := module.ExportedGlobal(name).(api.MutableGlobal); ok {
+			global.Set(value)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,181 @@
+package wazemmes
+
+import (
+	"context"
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+func TestSnapshotValidate(t *testing.T) {
+	module := moduleInterface{exports: map[string]byte{
+		"_initialize":      externFunc,
+		"_start":           externFunc,
+		"wizer.initialize": externFunc,
+		"handle":           externGlobal,
+	}}
+
+	for _, tc := range []struct {
+		name          string
+		configuration SnapshotConfiguration
+		err           string
+	}{
+		{name: "defaults"},
+		{name: "wizer init", configuration: SnapshotConfiguration{Init: "wizer.initialize"}},
+		{name: "missing init", configuration: SnapshotConfiguration{Init: "init"}, err: "snapshot init init"},
+		{name: "missing entry", configuration: SnapshotConfiguration{Entry: "run"}, err: "snapshot entry run"},
+		{name: "global entry", configuration: SnapshotConfiguration{Entry: "handle"}, err: "snapshot entry handle"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.configuration.validate(module)
+
+			switch {
+			case tc.err == "" && err != nil:
+				t.Errorf("got the error %v", err)
+			case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+				t.Errorf("got the error %v, expected %q", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestSnapshotCommandModule(t *testing.T) {
+	for builder, expected := range map[string]string{
+		"js":  "snapshot init _initialize",
+		"php": "doesn't support the snapshots",
+	} {
+		options := BuilderOptions{Source: buildGuest(t, "cgi"), Snapshot: &SnapshotConfiguration{}}
+		if builder == "php" {
+			options.Source, options.Interpreter = NewFileSource("index.php"), options.Source
+		}
+
+		h, err := NewWasmHandlerWithOptions(builder, options)
+		if err == nil {
+			_ = h.Close(t.Context())
+
+			t.Fatalf("%s: the command module is accepted", builder)
+		}
+
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("%s: got the error %v, expected %q", builder, err, expected)
+		}
+	}
+}
+
+// snapshotOutput is the output of the snapshot guest, its init replaces the
+// first ? by 1 in memory and sets the counter global to 2. Its handle export
+// replaces the second ? by the counter before writing the output.
+const snapshotOutput = `{"response":{"status":200,"body":"??"}}`
+
+// i32Const encodes an i32.const instruction of a positive value.
+func i32Const(value int) string {
+	code := []byte{0x41}
+	for ; value >= 0x40; value >>= 7 {
+		code = append(code, byte(value&0x7f|0x80))
+	}
+
+	return string(append(code, byte(value)))
+}
+
+// snapshotGuest returns a reactor module exporting its memory, a mutable
+// counter global and the init and handle functions.
+func snapshotGuest() []byte {
+	const iovec, nwritten, output = 0, 8, 16
+
+	first := output + strings.IndexByte(snapshotOutput, '?')
+	data := make([]byte, output, output+len(snapshotOutput))
+	binary.LittleEndian.PutUint32(data[iovec:], output)
+	binary.LittleEndian.PutUint32(data[iovec+4:], uint32(len(snapshotOutput)))
+	data = append(data, snapshotOutput...)
+
+	function := func(code string) string {
+		return string(rune(len(code)+2)) + "\x00" + code + "\x0b"
+	}
+
+	initialize := function(i32Const(first) + i32Const('1') + "\x3a\x00\x00" + i32Const(2) + "\x24\x00")
+	handle := function(i32Const(first+1) + "\x23\x00" + i32Const('0') + "\x6a\x3a\x00\x00" +
+		i32Const(1) + i32Const(iovec) + i32Const(1) + i32Const(nwritten) + "\x10\x00\x1a")
+
+	return wasmModule(
+		"\x01\x02\x60\x04\x7f\x7f\x7f\x7f\x01\x7f\x60\x00\x00",
+		"\x02\x01"+wasmName(wasiPreview1Module)+wasmName("fd_write")+"\x00\x00",
+		"\x03\x02\x01\x01",
+		"\x05\x01\x00\x01",
+		"\x06\x01\x7f\x01\x41\x00\x0b",
+		"\x07\x04"+wasmName("memory")+"\x02\x00"+wasmName("init")+"\x00\x01"+wasmName("handle")+"\x00\x02"+wasmName("counter")+"\x03\x00",
+		"\x0a\x02"+initialize+handle,
+		"\x0b\x01\x00\x41\x00\x0b"+string(rune(len(data)))+string(data),
+	)
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	ctx := context.Background()
+	code := snapshotGuest()
+
+	runtime := wazero.NewRuntime(ctx)
+	defer runtime.Close(ctx)
+
+	wasi_snapshot_preview1.MustInstantiate(ctx, runtime)
+
+	compiled, err := runtime.CompileModule(ctx, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	configuration := SnapshotConfiguration{Init: "init", Entry: "handle"}
+
+	snap, err := takeSnapshot(ctx, runtime, compiled, code, wazero.NewModuleConfig(), configuration)
+	if err != nil {
+		t.Fatalf("impossible to take the snapshot: %v", err)
+	}
+
+	if snap.globals["counter"] != 2 {
+		t.Errorf("got the captured globals %v, expected the counter at 2", snap.globals)
+	}
+
+	for name, tc := range map[string]struct {
+		snapshot *snapshot
+		expected string
+	}{
+		"restored": {snapshot: snap, expected: strings.Replace(snapshotOutput, "??", "12", 1)},
+		"fresh":    {expected: strings.Replace(snapshotOutput, "??", "?0", 1)},
+	} {
+		guest, err := instantiateGuest(ctx, runtime, compiled, wazero.NewModuleConfig(), tc.snapshot)
+		if err != nil {
+			t.Fatalf("%s: impossible to instantiate the guest: %v", name, err)
+		}
+
+		// The fresh guest has no snapshot entry, it runs handle directly.
+		if tc.snapshot == nil {
+			guest.entries = []string{configuration.entry()}
+		}
+
+		var stdout strings.Builder
+		if err = guest.run(ctx, nil, &stdout); err != nil {
+			t.Fatalf("%s: got the error %v", name, err)
+		}
+
+		if stdout.String() != tc.expected {
+			t.Errorf("%s: got the output %q, expected %q", name, stdout.String(), tc.expected)
+		}
+	}
+}
+
+func TestSnapshotServe(t *testing.T) {
+	rec, err := serveGuest(t, "js", BuilderOptions{
+		Source:   NewBytesSource("snapshot.wasm", snapshotGuest()),
+		Snapshot: &SnapshotConfiguration{Init: "init", Entry: "handle"},
+	}, httptest.NewRequest(http.MethodGet, "/", nil))
+	if err != nil {
+		t.Fatalf("got the error %v", err)
+	}
+
+	if rec.Code != http.StatusOK || rec.Body.String() != "12" {
+		t.Errorf("got the status %d and the body %q, expected 200 and the restored state", rec.Code, rec.Body.String())
+	}
+}
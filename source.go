@@ -0,0 +1,220 @@
+package wazemmes
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ModuleSource provides the WASM module bytes to the builders.
+type ModuleSource interface {
+	// Name identifies the module in the logs.
+	Name() string
+	// Bytes returns the module content.
+	Bytes() ([]byte, error)
+}
+
+// statSource is implemented by the sources that can be watched for changes.
+type statSource interface {
+	stat() (fs.FileInfo, error)
+}
+
+type fileSource struct {
+	path string
+}
+
+// NewFileSource reads the module from the filesystem each time it is
+// compiled.
+func NewFileSource(path string) ModuleSource {
+	return &fileSource{path: path}
+}
+
+func (s *fileSource) Name() string {
+	return s.path
+}
+
+func (s *fileSource) Bytes() ([]byte, error) {
+	return os.ReadFile(s.path)
+}
+
+func (s *fileSource) stat() (fs.FileInfo, error) {
+	return os.Stat(s.path)
+}
+
+var (
+	sharedFilesMu sync.Mutex
+	sharedFiles   = map[string]*sharedFile{}
+)
+
+// sharedFile is the content of a file as of its modification time and size,
+// it is kept while refs handlers use the file.
+type sharedFile struct {
+	refs    int
+	modTime time.Time
+	size    int64
+	code    []byte
+}
+
+// sharedSource is implemented by the sources sharing their content between
+// the handlers, the handlers retain them until they are closed.
+type sharedSource interface {
+	retain()
+	release()
+}
+
+type sharedFileSource struct {
+	fileSource
+}
+
+// NewSharedFileSource reads the module from the filesystem, the sources of
+// the same file share its content until the file changes or the last handler
+// using it is closed. It suits the large interpreters referenced by several
+// items.
+func NewSharedFileSource(path string) ModuleSource {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+
+	return &sharedFileSource{fileSource{path: path}}
+}
+
+func (s *sharedFileSource) retain() {
+	sharedFilesMu.Lock()
+	defer sharedFilesMu.Unlock()
+
+	shared, ok := sharedFiles[s.path]
+	if !ok {
+		shared = &sharedFile{}
+		sharedFiles[s.path] = shared
+	}
+
+	shared.refs++
+}
+
+func (s *sharedFileSource) release() {
+	sharedFilesMu.Lock()
+	defer sharedFilesMu.Unlock()
+
+	shared, ok := sharedFiles[s.path]
+	if !ok {
+		return
+	}
+
+	if shared.refs--; shared.refs <= 0 {
+		delete(sharedFiles, s.path)
+	}
+}
+
+// Bytes returns the shared content while the file is retained, the file is
+// read each time otherwise.
+func (s *sharedFileSource) Bytes() ([]byte, error) {
+	info, err := s.stat()
+	if err != nil {
+		return nil, err
+	}
+
+	sharedFilesMu.Lock()
+	defer sharedFilesMu.Unlock()
+
+	shared, ok := sharedFiles[s.path]
+	if ok && shared.code != nil && shared.modTime.Equal(info.ModTime()) && shared.size == info.Size() {
+		return shared.code, nil
+	}
+
+	code, err := s.fileSource.Bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	if ok {
+		shared.modTime, shared.size, shared.code = info.ModTime(), info.Size(), code
+	}
+
+	return code, nil
+}
+
+// retainSources retains the shared sources among the sources.
+func retainSources(sources []ModuleSource) []sharedSource {
+	retained := make([]sharedSource, 0, len(sources))
+
+	for _, source := range sources {
+		if shared, ok := source.(sharedSource); ok {
+			shared.retain()
+			retained = append(retained, shared)
+		}
+	}
+
+	return retained
+}
+
+type fsSource struct {
+	fsys fs.FS
+	path string
+}
+
+// NewFSSource reads the module from an fs.FS, e.g. an embed.FS.
+func NewFSSource(fsys fs.FS, path string) ModuleSource {
+	return &fsSource{fsys: fsys, path: path}
+}
+
+func (s *fsSource) Name() string {
+	return s.path
+}
+
+func (s *fsSource) Bytes() ([]byte, error) {
+	return fs.ReadFile(s.fsys, s.path)
+}
+
+func (s *fsSource) stat() (fs.FileInfo, error) {
+	return fs.Stat(s.fsys, s.path)
+}
+
+type bytesSource struct {
+	name string
+	code []byte
+}
+
+// NewBytesSource uses the given bytes as module, e.g. a go:embed []byte.
+func NewBytesSource(name string, code []byte) ModuleSource {
+	return &bytesSource{name: name, code: code}
+}
+
+func (s *bytesSource) Name() string {
+	return s.name
+}
+
+func (s *bytesSource) Bytes() ([]byte, error) {
+	return s.code, nil
+}
+
+type readerSource struct {
+	name   string
+	reader io.Reader
+	once   sync.Once
+	code   []byte
+	err    error
+}
+
+// NewReaderSource consumes the reader on the first compilation and keeps its
+// content for the next ones.
+func NewReaderSource(name string, reader io.Reader) ModuleSource {
+	return &readerSource{name: name, reader: reader}
+}
+
+func (s *readerSource) Name() string {
+	return s.name
+}
+
+func (s *readerSource) Bytes() ([]byte, error) {
+	s.once.Do(func() {
+		buf := new(bytes.Buffer)
+		_, s.err = io.Copy(buf, s.reader)
+		s.code = buf.Bytes()
+	})
+
+	return s.code, s.err
+}
@@ -0,0 +1,138 @@
+package wazemmes
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"testing/iotest"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestSources(t *testing.T) {
+	errRead := errors.New("read error")
+	fsys := fstest.MapFS{"plugins/plugin.wasm": {Data: []byte("code"), ModTime: time.Unix(1, 0)}}
+
+	for _, tc := range []struct {
+		name      string
+		source    ModuleSource
+		code      string
+		err       error
+		watchable bool
+	}{
+		{name: "bytes", source: NewBytesSource("bytes", []byte("code")), code: "code"},
+		{name: "reader", source: NewReaderSource("reader", strings.NewReader("code")), code: "code"},
+		{name: "reader", source: NewReaderSource("reader", iotest.ErrReader(errRead)), err: errRead},
+		{name: "plugins/plugin.wasm", source: NewFSSource(fsys, "plugins/plugin.wasm"), code: "code", watchable: true},
+		{name: "plugins/missing.wasm", source: NewFSSource(fsys, "plugins/missing.wasm"), err: fs.ErrNotExist, watchable: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.source.Name(); got != tc.name {
+				t.Errorf("got the name %q, expected %q", got, tc.name)
+			}
+
+			// The reader is only consumed once, the next reads return the
+			// same content.
+			for range 2 {
+				code, err := tc.source.Bytes()
+				if !errors.Is(err, tc.err) || string(code) != tc.code {
+					t.Errorf("got the code %q and the error %v, expected %q and %v", code, err, tc.code, tc.err)
+				}
+			}
+
+			if _, ok := tc.source.(statSource); ok != tc.watchable {
+				t.Errorf("the source can be watched: %t, expected %t", ok, tc.watchable)
+			}
+		})
+	}
+}
+
+func TestFSSourceChanges(t *testing.T) {
+	fsys := fstest.MapFS{"plugin.wasm": {Data: []byte("code"), ModTime: time.Unix(1, 0)}}
+	source := NewFSSource(fsys, "plugin.wasm")
+
+	// Only the files can be watched.
+	files := (&WasmHandler{}).watchedFiles([]ModuleSource{source, NewFSSource(fsys, "."), NewBytesSource("bytes", nil)})
+	if len(files) != 1 {
+		t.Fatalf("got %d watched files, expected the module only", len(files))
+	}
+
+	for _, tc := range []struct {
+		name    string
+		file    *fstest.MapFile
+		changed bool
+	}{
+		{name: "unchanged", file: &fstest.MapFile{Data: []byte("code"), ModTime: time.Unix(1, 0)}},
+		{name: "modification time", file: &fstest.MapFile{Data: []byte("code"), ModTime: time.Unix(2, 0)}, changed: true},
+		{name: "already seen", file: &fstest.MapFile{Data: []byte("code"), ModTime: time.Unix(2, 0)}},
+		{name: "size", file: &fstest.MapFile{Data: []byte("new code"), ModTime: time.Unix(2, 0)}, changed: true},
+		{name: "removed"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			delete(fsys, "plugin.wasm")
+			if tc.file != nil {
+				fsys["plugin.wasm"] = tc.file
+			}
+
+			if changed := files[0].changed(); changed != tc.changed {
+				t.Errorf("got a change %t, expected %t", changed, tc.changed)
+			}
+
+			if code, err := source.Bytes(); tc.file != nil && (err != nil || string(code) != string(tc.file.Data)) {
+				t.Errorf("got the code %q and the error %v, expected %q", code, err, tc.file.Data)
+			}
+		})
+	}
+}
+
+func TestSharedFileSource(t *testing.T) {
+	path := copyGuest(t, "cgi")
+
+	shared := func() *sharedFile {
+		sharedFilesMu.Lock()
+		defer sharedFilesMu.Unlock()
+
+		return sharedFiles[path]
+	}
+
+	// The content isn't kept without a handler using the file.
+	if _, err := NewSharedFileSource(path).Bytes(); err != nil || shared() != nil {
+		t.Fatalf("got the error %v and the shared file %v, expected nothing kept", err, shared())
+	}
+
+	handlers := make([]*WasmHandler, 0, 2)
+
+	for range 2 {
+		h, err := NewWasmHandlerWithOptions("php", BuilderOptions{
+			Source:      NewFileSource("index.php"),
+			Interpreter: NewSharedFileSource(path),
+			Logger:      zap.NewNop(),
+		})
+		if err != nil {
+			t.Fatalf("impossible to build the handler: %v", err)
+		}
+
+		handlers = append(handlers, h)
+	}
+
+	if file := shared(); file == nil || file.refs != 2 || file.code == nil {
+		t.Fatalf("got the shared file %v, expected the content used by both handlers", file)
+	}
+
+	_ = handlers[0].Close(context.Background())
+	_ = handlers[0].Close(context.Background())
+
+	if file := shared(); file == nil || file.refs != 1 {
+		t.Fatalf("got the shared file %v, expected the content kept for the last handler", file)
+	}
+
+	_ = handlers[1].Close(context.Background())
+
+	if file := shared(); file != nil {
+		t.Errorf("the shared file was kept after the last handler was closed")
+	}
+}
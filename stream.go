@@ -0,0 +1,206 @@
+package wazemmes
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+)
+
+var ErrBodyTooLarge = errors.New("the request body exceeds the maximum body size")
+
+// spoolMemory is the part of a streamed body kept in memory, the rest is
+// written in a temporary file.
+const spoolMemory = 1 << 20
+
+// limitBody bounds the request body to maxBodySize, it returns false when the
+// request declares a larger body.
+func limitBody(rw http.ResponseWriter, req *http.Request, maxBodySize int64) bool {
+	if maxBodySize <= 0 || req.Body == nil {
+		return true
+	}
+
+	if req.ContentLength > maxBodySize {
+		return false
+	}
+
+	req.Body = http.MaxBytesReader(rw, req.Body, maxBodySize)
+
+	return true
+}
+
+func isBodyTooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+
+	return errors.As(err, &maxBytesErr)
+}
+
+func rejectBody(rw http.ResponseWriter) error {
+	rw.WriteHeader(http.StatusRequestEntityTooLarge)
+	_, _ = rw.Write([]byte(http.StatusText(http.StatusRequestEntityTooLarge)))
+
+	return ErrBodyTooLarge
+}
+
+// spool records a body streamed to a guest, so the downstream handlers can
+// read it again.
+type spool struct {
+	memory bytes.Buffer
+	file   *os.File
+	size   int64
+}
+
+func (s *spool) Write(b []byte) (int, error) {
+	if s.file == nil && s.memory.Len()+len(b) <= spoolMemory {
+		return s.memory.Write(b)
+	}
+
+	if s.file == nil {
+		file, err := os.CreateTemp("", "wazemmes-body-*")
+		if err != nil {
+			return 0, err
+		}
+
+		s.file = file
+	}
+
+	n, err := s.file.Write(b)
+	s.size += int64(n)
+
+	return n, err
+}
+
+func (s *spool) len() int64 {
+	return int64(s.memory.Len()) + s.size
+}
+
+// reader replays the recorded body.
+func (s *spool) reader() io.ReadCloser {
+	readers := []io.Reader{bytes.NewReader(s.memory.Bytes())}
+	if s.file != nil {
+		readers = append(readers, io.NewSectionReader(s.file, 0, s.size))
+	}
+
+	return io.NopCloser(io.MultiReader(readers...))
+}
+
+// Close removes the temporary file once the request is served.
+func (s *spool) Close() error {
+	if s.file == nil {
+		return nil
+	}
+
+	name := s.file.Name()
+	err := s.file.Close()
+
+	return errors.Join(err, os.Remove(name))
+}
+
+// streamBody tees the request body into a spool while the guest reads it.
+// The returned function drains what the guest didn't read, and replays the
+// whole body for the downstream handlers.
+func streamBody(req *http.Request) (io.Reader, *spool, func() error) {
+	s := &spool{}
+	if req.Body == nil {
+		return http.NoBody, s, func() error { return nil }
+	}
+
+	body := req.Body
+	tee := io.TeeReader(body, s)
+
+	return tee, s, func() error {
+		_, err := io.Copy(io.Discard, tee)
+		_ = body.Close()
+
+		req.Body = s.reader()
+
+		return err
+	}
+}
+
+// flushWriter flushes each write of a streamed response to the client.
+type flushWriter struct {
+	rw http.ResponseWriter
+}
+
+// newFlushWriter sends what was written so far, the headers included.
+func newFlushWriter(rw http.ResponseWriter) flushWriter {
+	f := flushWriter{rw: rw}
+	f.flush()
+
+	return f
+}
+
+func (f flushWriter) Write(b []byte) (int, error) {
+	n, err := f.rw.Write(b)
+	f.flush()
+
+	return n, err
+}
+
+func (f flushWriter) flush() {
+	if flusher, ok := f.rw.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// streamWriter is the stdout of a guest streaming its response. It buffers
+// the output until parse finds the end of its header block, then writes the
+// rest to the writer returned by onHeader as it comes. An output parse can't
+// read is buffered as a whole, for the caller to report it.
+type streamWriter struct {
+	buf bytes.Buffer
+	// parse returns the length of the header block, and false while it is
+	// incomplete.
+	parse    func(data []byte) (int, bool, error)
+	onHeader func(header []byte) (io.Writer, error)
+	body     io.Writer
+	invalid  bool
+}
+
+func (s *streamWriter) Write(b []byte) (int, error) {
+	if s.body != nil {
+		return s.body.Write(b)
+	}
+
+	s.buf.Write(b)
+
+	if s.invalid {
+		return len(b), nil
+	}
+
+	n, ok, err := s.parse(s.buf.Bytes())
+	if err != nil {
+		s.invalid = true
+
+		return len(b), nil
+	}
+
+	if !ok {
+		return len(b), nil
+	}
+
+	body, err := s.onHeader(s.buf.Bytes()[:n])
+	if err != nil {
+		return 0, err
+	}
+
+	s.body = body
+
+	if rest := s.buf.Bytes()[n:]; len(rest) > 0 {
+		if _, err = body.Write(rest); err != nil {
+			return 0, err
+		}
+	}
+
+	s.buf.Reset()
+
+	return len(b), nil
+}
+
+// started reports whether the header block was handled, the buffered output
+// is processed as a whole otherwise.
+func (s *streamWriter) started() bool {
+	return s.body != nil
+}
@@ -0,0 +1,47 @@
+// Command cgi is the CGI guest of the tests, they build it with GOOS=wasip1
+// GOARCH=wasm. It dumps its arguments and environment, the /continue path
+// hands the request to the next handler and the /slow one runs until the
+// guest is aborted, /slow-stream once its response started.
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+)
+
+func main() {
+	body, _ := io.ReadAll(os.Stdin)
+	path, _, _ := strings.Cut(os.Getenv("REQUEST_URI"), "?")
+
+	// The guest clock is fake, /slow spins instead of sleeping.
+	for path == "/slow" {
+	}
+
+	if path == "/slow-stream" {
+		fmt.Print("Content-Type: text/plain\n\npartial")
+
+		for {
+		}
+	}
+
+	if path == "/continue" {
+		fmt.Print("X-Wazemmes-Action: continue\nX-Guest: continued\n\nignored")
+
+		return
+	}
+
+	env := os.Environ()
+	slices.Sort(env)
+
+	fmt.Print("Content-Type: text/plain\n\n")
+	fmt.Printf("args=%q\n", os.Args)
+
+	for _, variable := range env {
+		fmt.Println(variable)
+	}
+
+	fmt.Printf("body=%q\n", body)
+}
@@ -0,0 +1,48 @@
+// Command js is the JSON guest of the tests, they build it with GOOS=wasip1
+// GOARCH=wasm. It sets the X-Guest response header in the request phase and
+// returns its input unchanged in the response phase. It prints the value of
+// the X-Trailing request header after its message.
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+)
+
+type message struct {
+	Context  string          `json:"context,omitempty"`
+	Version  int             `json:"version,omitempty"`
+	Request  json.RawMessage `json:"request"`
+	Response struct {
+		Headers http.Header `json:"headers"`
+		Body    string      `json:"body"`
+		Status  int         `json:"status"`
+	} `json:"response"`
+	Error  string `json:"error"`
+	Action string `json:"action,omitempty"`
+}
+
+func main() {
+	var m message
+	if err := json.NewDecoder(os.Stdin).Decode(&m); err != nil {
+		os.Exit(1)
+	}
+
+	if m.Context == "request" {
+		m.Response.Headers = http.Header{"X-Guest": {"request"}}
+		m.Response.Body = "guest"
+	}
+
+	m.Context, m.Version = "", 0
+
+	_ = json.NewEncoder(os.Stdout).Encode(m)
+
+	var request struct {
+		Headers http.Header `json:"headers"`
+	}
+
+	if json.Unmarshal(m.Request, &request) == nil {
+		_, _ = os.Stdout.WriteString(request.Headers.Get("X-Trailing"))
+	}
+}
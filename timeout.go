@@ -0,0 +1,111 @@
+package wazemmes
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const defaultTimeoutStatus = http.StatusGatewayTimeout
+
+var (
+	ErrGuestTimeout  = errors.New("the WASM guest exceeded its execution timeout")
+	ErrGuestCanceled = errors.New("the WASM guest was aborted because the request was canceled")
+)
+
+// guestTimer aborts the guest once it ran longer than the timeout, or when
+// the request is canceled while it runs. The time spent in the downstream
+// handlers doesn't count, and a request canceled meanwhile isn't a guest
+// abort.
+type guestTimer struct {
+	mu     sync.Mutex
+	parent context.Context
+	cancel context.CancelCauseFunc
+	// detached ignores the cancellation of a request canceled while the
+	// downstream handlers ran, it is notified asynchronously.
+	detached  bool
+	timer     *time.Timer
+	remaining time.Duration
+	resumed   time.Time
+	paused    bool
+}
+
+// withGuestTimeout returns the context the guest runs with, it is canceled
+// with ErrGuestTimeout by the timer, or with ErrGuestCanceled when the
+// request context is done while the guest runs.
+func withGuestTimeout(parent context.Context, timeout time.Duration) (context.Context, *guestTimer, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(context.WithoutCancel(parent))
+
+	t := &guestTimer{
+		parent:    parent,
+		cancel:    cancel,
+		remaining: timeout,
+		resumed:   time.Now(),
+	}
+
+	if timeout > 0 {
+		t.timer = time.AfterFunc(timeout, func() {
+			cancel(ErrGuestTimeout)
+		})
+	}
+
+	stop := context.AfterFunc(parent, t.canceled)
+
+	return ctx, t, func() {
+		stop()
+
+		if t.timer != nil {
+			t.timer.Stop()
+		}
+
+		cancel(nil)
+	}
+}
+
+func (t *guestTimer) canceled() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.paused && !t.detached {
+		t.cancel(ErrGuestCanceled)
+	}
+}
+
+func (t *guestTimer) pause() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.paused = true
+
+	if t.timer != nil && t.timer.Stop() {
+		t.remaining -= time.Since(t.resumed)
+	}
+}
+
+func (t *guestTimer) resume() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.paused = false
+	t.detached = t.detached || t.parent.Err() != nil
+
+	if t.timer != nil && t.remaining > 0 {
+		t.resumed = time.Now()
+		t.timer.Reset(t.remaining)
+	}
+}
+
+// guestAbortError returns the reason why the guest was aborted, if it was.
+func guestAbortError(ctx context.Context) error {
+	if ctx.Err() == nil {
+		return nil
+	}
+
+	if errors.Is(context.Cause(ctx), ErrGuestTimeout) {
+		return ErrGuestTimeout
+	}
+
+	return ErrGuestCanceled
+}
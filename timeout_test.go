@@ -0,0 +1,69 @@
+package wazemmes
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestCanceledDuringNextIsNotAnAbort(t *testing.T) {
+	h, err := NewWasmHandlerWithOptions("js", BuilderOptions{
+		Source:         buildGuest(t, "js"),
+		HandleResponse: true,
+		Timeout:        time.Minute,
+		Logger:         zap.NewNop(),
+	})
+	if err != nil {
+		t.Fatalf("impossible to build the handler: %v", err)
+	}
+
+	defer func() {
+		_ = h.Close(context.Background())
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The client disconnects while the downstream handler runs.
+	next := HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) error {
+		cancel()
+		_, _ = rw.Write([]byte("upstream"))
+
+		return nil
+	})
+
+	rec := httptest.NewRecorder()
+
+	if err = h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx), next); err != nil {
+		t.Fatalf("got the error %v", err)
+	}
+
+	if rec.Body.String() != "upstream" {
+		t.Errorf("got the body %q, expected the response phase output", rec.Body.String())
+	}
+
+	if destroyed := h.generation.Load().pool.GetDestroyedCount(); destroyed != 0 {
+		t.Errorf("%d instances were invalidated", destroyed)
+	}
+}
+
+func TestTimeoutAfterTheResponseStarted(t *testing.T) {
+	rec, err := serveGuest(t, "cgi", BuilderOptions{
+		Source:         buildGuest(t, "cgi"),
+		Timeout:        200 * time.Millisecond,
+		StreamResponse: true,
+	}, httptest.NewRequest(http.MethodGet, "/slow-stream", nil))
+
+	if !errors.Is(err, ErrGuestTimeout) {
+		t.Errorf("got the error %v, expected %v", err, ErrGuestTimeout)
+	}
+
+	if rec.Code != http.StatusOK || rec.Body.String() != "partial" {
+		t.Errorf("got the status %d and the body %q, expected the started response only", rec.Code, rec.Body.String())
+	}
+}
@@ -1,26 +1,39 @@
-type Context = 'request' | 'response';
+type Context = 'handshake' | 'request' | 'response';
+type Action = 'continue' | 'respond' | 'redirect';
+// The binary bodies are carried in base64, the others are UTF-8 text.
+type BodyEncoding = 'base64';
 type Request = {
     method: string;
     url: string;
     headers: Record<string, string[]>;
     body: string;
+    bodyEncoding?: BodyEncoding;
+    stream?: boolean;
 };
 type Response = {
     status: number;
-    headers: Record<string, string[]>;
+    headers: Record<string, string[] | null>;
+    trailers?: Record<string, string[]>;
     body: string;
+    bodyEncoding?: BodyEncoding;
+    chunks?: Iterable<string | Uint8Array>;
 };
 type BaseHandler = {
     request: Request;
     response: Response;
     error: '';
+    action?: Action;
+    // The protocol version spoken by the guest, answered to the handshake.
+    version?: number;
 };
 type Input = BaseHandler & {
     context: Context;
+    version: number;
 };
 type Output = BaseHandler;
 type HandleRequest = (input: Input) => Output;
 type HandleResponse = (input: Input) => Output;
+export declare const PROTOCOL_VERSION = 2;
 export declare function handleWasm(handleRequest: HandleRequest, handleResponse: HandleResponse): void;
 export {};
 //# sourceMappingURL=index.d.ts.map
\ No newline at end of file
@@ -29,50 +29,309 @@ function readInput() {
         { bufferOffset: 0, finalBuffer: new Uint8Array(totalBytes) },
     );
 
-    const maybeJson = new TextDecoder().decode(finalBuffer);
+    if (isBinary(finalBuffer)) {
+        return { binary: true, input: decodeBinary(finalBuffer) };
+    }
+
+    // A streamed body follows the JSON message and its newline
+    const newline = finalBuffer.indexOf(0x0a);
+    const message = newline === -1 ? finalBuffer : finalBuffer.subarray(0, newline);
+    const maybeJson = new TextDecoder().decode(message);
     try {
-        return JSON.parse(maybeJson);
+        const input = JSON.parse(maybeJson);
+        if (input.request?.stream) {
+            Object.assign(input.request, decodeBody(finalBuffer.subarray(newline + 1)));
+        }
+        return { binary: false, input };
     } catch {
-        return {};
+        return { binary: false, input: {} };
+    }
+}
+
+// Write output to stdout, in the encoding of the input. The response chunks
+// follow the message, they are streamed to the client with the
+// stream_response directive and appended to the body otherwise.
+function writeOutput(output: Output, binary: boolean) {
+    const { chunks, ...response } = output.response ?? {};
+    const message = output.response ? { ...output, response: response as Response } : output;
+    const buffer = binary ? encodeBinary(message) : new TextEncoder().encode(JSON.stringify(message) + '\n');
+    writeStdout(buffer);
+    for (const chunk of chunks ?? []) {
+        writeStdout(typeof chunk === 'string' ? new TextEncoder().encode(chunk) : chunk);
     }
 }
 
-// Write output to stdout
-function writeOutput(output: Output) {
-    const encodedOutput = new TextEncoder().encode(JSON.stringify(output));
-    const buffer = new Uint8Array(encodedOutput);
+function writeStdout(buffer: Uint8Array) {
     // Stdout file descriptor
     const fd = 1;
     // @ts-ignore
     Javy.IO.writeSync(fd, buffer);
 }
 
-type Context = 'request' | 'response';
+// The binary encoding of the host starts with the WZB1 magic, its strings and
+// bodies are prefixed by their big-endian uint32 length.
+const MAGIC = [0x57, 0x5a, 0x42, 0x31];
+const ABSENT = 0xffffffff;
+const BASE64 = 'ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/';
+
+function isBinary(buffer: Uint8Array): boolean {
+    return buffer.length >= MAGIC.length && MAGIC.every((byte, i) => buffer[i] === byte);
+}
+
+function toBase64(bytes: Uint8Array): string {
+    let output = '';
+    for (let i = 0; i < bytes.length; i += 3) {
+        const chunk = ((bytes[i] ?? 0) << 16) | ((bytes[i + 1] ?? 0) << 8) | (bytes[i + 2] ?? 0);
+        output += BASE64.charAt((chunk >> 18) & 63) + BASE64.charAt((chunk >> 12) & 63);
+        output += i + 1 < bytes.length ? BASE64.charAt((chunk >> 6) & 63) : '=';
+        output += i + 2 < bytes.length ? BASE64.charAt(chunk & 63) : '=';
+    }
+
+    return output;
+}
+
+function fromBase64(value: string): Uint8Array {
+    const clean = value.replace(/=+$/, '');
+    const bytes = new Uint8Array(Math.floor((clean.length * 3) / 4));
+    let buffer = 0;
+    let bits = 0;
+    let offset = 0;
+    for (const char of clean) {
+        buffer = (buffer << 6) | BASE64.indexOf(char);
+        bits += 6;
+        if (bits >= 8) {
+            bits -= 8;
+            bytes[offset++] = (buffer >> bits) & 0xff;
+        }
+    }
+
+    return bytes;
+}
+
+class BinaryReader {
+    private offset = MAGIC.length;
+    private readonly view: DataView;
+
+    constructor(private readonly buffer: Uint8Array) {
+        this.view = new DataView(buffer.buffer, buffer.byteOffset, buffer.byteLength);
+    }
+
+    uint32(): number {
+        const value = this.view.getUint32(this.offset);
+        this.offset += 4;
+
+        return value;
+    }
+
+    bytes(): Uint8Array | null {
+        const length = this.uint32();
+        if (length === ABSENT) {
+            return null;
+        }
+        const value = this.buffer.subarray(this.offset, this.offset + length);
+        this.offset += length;
+
+        return value;
+    }
+
+    string(): string {
+        const value = this.bytes();
+
+        return value ? new TextDecoder().decode(value) : '';
+    }
+
+    headers(): Record<string, string[]> {
+        const headers: Record<string, string[]> = {};
+        const count = this.uint32();
+        if (count === ABSENT) {
+            return headers;
+        }
+        for (let i = 0; i < count; i++) {
+            const key = this.string();
+            const length = this.uint32();
+            const values: string[] = [];
+            for (let j = 0; length !== ABSENT && j < length; j++) {
+                values.push(this.string());
+            }
+            headers[key] = values;
+        }
+
+        return headers;
+    }
+
+    body(): { body: string; bodyEncoding?: BodyEncoding } {
+        return decodeBody(this.bytes() ?? new Uint8Array());
+    }
+
+    // The bytes following the message
+    rest(): Uint8Array {
+        return this.buffer.subarray(this.offset);
+    }
+}
+
+// The bodies are handed as text, or as base64 when they aren't UTF-8.
+function decodeBody(bytes: Uint8Array): { body: string; bodyEncoding?: BodyEncoding } {
+    try {
+        return { body: new TextDecoder('utf-8', { fatal: true }).decode(bytes) };
+    } catch {
+        return { body: toBase64(bytes), bodyEncoding: 'base64' };
+    }
+}
+
+function decodeBinary(buffer: Uint8Array): Input {
+    const reader = new BinaryReader(buffer);
+    const context = reader.string() as Context;
+    const version = reader.uint32();
+    const error = reader.string() as '';
+    const action = reader.string();
+    const method = reader.string();
+    const url = reader.string();
+    const headers = reader.headers();
+    // An absent request body is streamed after the message
+    const body = reader.bytes();
+    const response: Response = {
+        status: reader.uint32(),
+        headers: reader.headers(),
+        trailers: reader.headers(),
+        ...reader.body(),
+    };
+    const request: Request = {
+        method,
+        url,
+        headers,
+        ...decodeBody(body ?? reader.rest()),
+        ...(body === null ? { stream: true } : {}),
+    };
+
+    return {
+        context,
+        version,
+        error,
+        ...(action ? { action: action as Action } : {}),
+        request,
+        response,
+    };
+}
+
+class BinaryWriter {
+    private readonly chunks: Uint8Array[] = [new Uint8Array(MAGIC)];
+
+    uint32(value: number) {
+        const chunk = new Uint8Array(4);
+        new DataView(chunk.buffer).setUint32(0, value);
+        this.chunks.push(chunk);
+    }
+
+    bytes(value: Uint8Array) {
+        this.uint32(value.length);
+        this.chunks.push(value);
+    }
+
+    string(value: string | undefined) {
+        this.bytes(new TextEncoder().encode(value ?? ''));
+    }
+
+    headers(headers: Record<string, string[] | null> | undefined) {
+        if (!headers) {
+            this.uint32(ABSENT);
+            return;
+        }
+        const keys = Object.keys(headers);
+        this.uint32(keys.length);
+        for (const key of keys) {
+            this.string(key);
+            const values = headers[key];
+            if (!values) {
+                this.uint32(ABSENT);
+                continue;
+            }
+            this.uint32(values.length);
+            values.forEach((value) => this.string(value));
+        }
+    }
+
+    body(body: string | null | undefined, bodyEncoding: BodyEncoding | undefined) {
+        if (body === null || body === undefined) {
+            this.uint32(ABSENT);
+            return;
+        }
+        this.bytes(bodyEncoding === 'base64' ? fromBase64(body) : new TextEncoder().encode(body));
+    }
+
+    concat(): Uint8Array {
+        const length = this.chunks.reduce((total, chunk) => total + chunk.length, 0);
+        const buffer = new Uint8Array(length);
+        let offset = 0;
+        for (const chunk of this.chunks) {
+            buffer.set(chunk, offset);
+            offset += chunk.length;
+        }
+
+        return buffer;
+    }
+}
+
+function encodeBinary(output: Output): Uint8Array {
+    const writer = new BinaryWriter();
+    writer.string('');
+    writer.uint32(output.version ?? 0);
+    writer.string(output.error ?? '');
+    writer.string(output.action ?? '');
+    writer.string(output.request?.method);
+    writer.string(output.request?.url);
+    writer.headers(output.request?.headers);
+    writer.body(output.request?.body, output.request?.bodyEncoding);
+    writer.uint32(output.response?.status ?? 0);
+    writer.headers(output.response?.headers);
+    writer.headers(output.response?.trailers);
+    writer.body(output.response?.body, output.response?.bodyEncoding);
+
+    return writer.concat();
+}
+
+type Context = 'handshake' | 'request' | 'response';
+type Action = 'continue' | 'respond' | 'redirect';
+// The binary bodies are carried in base64, the others are UTF-8 text.
+type BodyEncoding = 'base64';
 type Request = {
     method: string;
     url: string;
     headers: Record<string, string[]>;
     body: string;
+    bodyEncoding?: BodyEncoding;
+    // The body was streamed after the message
+    stream?: boolean;
 };
 type Response = {
     status: number;
-    headers: Record<string, string[]>;
+    headers: Record<string, string[] | null>;
+    trailers?: Record<string, string[]>;
     body: string;
+    bodyEncoding?: BodyEncoding;
+    // The chunks written after the body, a generator can produce them lazily.
+    chunks?: Iterable<string | Uint8Array>;
 }
 
 type BaseHandler = {
     request: Request;
     response: Response;
     error: '';
+    action?: Action;
+    // The protocol version spoken by the guest, answered to the handshake.
+    version?: number;
 }
 
-type Input = BaseHandler & { context: Context };
+type Input = BaseHandler & { context: Context; version: number };
 type Output = BaseHandler;
 
+// The version of the host protocol implemented by this package.
+export const PROTOCOL_VERSION = 2;
+
 type HandleRequest = (input: Input) => Output;
 type HandleResponse = (input: Input) => Output;
 
 export function handleWasm(handleRequest: HandleRequest, handleResponse: HandleResponse) {
+    const { binary, input: received } = readInput();
     const input = {
         context: null,
         response: {
@@ -81,7 +340,7 @@ export function handleWasm(handleRequest: HandleRequest, handleResponse: HandleR
         },
         request: {},
         error: null,
-        ...readInput(),
+        ...received,
     };
     let output: Output = {
         request: {
@@ -99,6 +358,9 @@ export function handleWasm(handleRequest: HandleRequest, handleResponse: HandleR
     };
 
     switch (input.context) {
+        case 'handshake':
+            output = { ...output, version: PROTOCOL_VERSION };
+            break;
         case 'request':
             output = handleRequest(input);
             break;
@@ -107,5 +369,5 @@ export function handleWasm(handleRequest: HandleRequest, handleResponse: HandleR
             break;
     }
 
-    writeOutput(output);
+    writeOutput(output, binary);
 }
@@ -0,0 +1,283 @@
+package wazemmes
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/tetratelabs/wazero"
+)
+
+// Route runs the module of its Source for the requests of its Path. A path
+// ending with "/..." matches every path under it, WAGI style, the others match
+// exactly.
+type Route struct {
+	Path   string
+	Source ModuleSource
+}
+
+// wildcardSuffix marks the prefix routes.
+const wildcardSuffix = "/..."
+
+// cgiRoute is a compiled route.
+type cgiRoute struct {
+	pattern  string
+	path     string
+	prefix   bool
+	compiled wazero.CompiledModule
+}
+
+func (c cgiRoute) match(urlPath string) (script, bool) {
+	switch {
+	case urlPath == c.path:
+		return script{name: c.path}, true
+	case !c.prefix:
+		return script{}, false
+	case c.path == "/":
+		return script{pathInfo: urlPath}, true
+	case strings.HasPrefix(urlPath, c.path+"/"):
+		return script{name: c.path, pathInfo: urlPath[len(c.path):]}, true
+	}
+
+	return script{}, false
+}
+
+// cgiWASMHandler runs WASI command modules as CGI scripts: the request body
+// is on their stdin and their stdout is a CGI response.
+type cgiWASMHandler struct {
+	cgiRunner
+	// routes are sorted from the most specific one.
+	routes []cgiRoute
+	mounts []Mount
+}
+
+// route returns the index of the route matching the URL path, and false when
+// none does.
+func (h *cgiWASMHandler) route(urlPath string) (int, script, bool) {
+	clean := path.Clean("/" + urlPath)
+
+	for i, route := range h.routes {
+		if target, ok := route.match(clean); ok {
+			return i, target, true
+		}
+	}
+
+	return 0, script{}, false
+}
+
+// moduleConfig mounts the configured mounts only, the modules see no host
+// directory by default.
+func (h *cgiWASMHandler) moduleConfig() wazero.ModuleConfig {
+	config := wazero.NewModuleConfig().WithStderr(os.Stderr)
+
+	if len(h.mounts) > 0 {
+		fsConfig := wazero.NewFSConfig()
+		for _, m := range h.mounts {
+			fsConfig = m.apply(fsConfig)
+		}
+
+		config = config.WithFSConfig(fsConfig)
+	}
+
+	return config
+}
+
+// serve runs the module of the request route, see cgiRunner.serve. Next to
+// the CGI environment, the modules receive the WAGI variables and the query
+// parameters as arguments.
+func (h *cgiWASMHandler) serve(rw http.ResponseWriter, r *http.Request, next Handler, i *cgiInstance) error {
+	return h.cgiRunner.serve(rw, r, next, func(r *http.Request) (cgiRun, bool) {
+		index, target, ok := h.route(r.URL.Path)
+		if !ok {
+			return cgiRun{}, false
+		}
+
+		return cgiRun{
+			take: func(ctx context.Context) (*guestModule, error) {
+				return i.take(ctx, index)
+			},
+			args: cgiArgs(target, r.URL.RawQuery),
+			env: func(contentLength int64) map[string]string {
+				env := cgiEnv(r, cgiRequest{
+					script:        target,
+					documentRoot:  "/",
+					contentLength: contentLength,
+				})
+				env["X_MATCHED_ROUTE"] = h.routes[index].pattern
+				env["X_RAW_PATH_INFO"] = (&url.URL{Path: target.pathInfo}).EscapedPath()
+				env["X_FULL_URL"] = env["REQUEST_SCHEME"] + "://" + r.Host + env["REQUEST_URI"]
+
+				return env
+			},
+		}, true
+	})
+}
+
+// cgiArgs returns the script name followed by the decoded query parameters.
+func cgiArgs(target script, rawQuery string) []string {
+	args := []string{target.name}
+	if target.name == "" {
+		args[0] = "/"
+	}
+
+	for _, param := range strings.Split(rawQuery, "&") {
+		if param == "" {
+			continue
+		}
+
+		if decoded, err := url.QueryUnescape(param); err == nil {
+			param = decoded
+		}
+
+		args = append(args, param)
+	}
+
+	return args
+}
+
+// cgiInstance keeps the module of each route instantiated ahead of the next
+// request, the CGI environment is given when it runs.
+type cgiInstance struct {
+	*guestSlots
+	handler *cgiWASMHandler
+}
+
+func (h *cgiWASMHandler) newInstance(ctx context.Context) (instance, error) {
+	slots, err := newGuestSlots(ctx, len(h.routes), func(ctx context.Context, route int) (*guestModule, error) {
+		return instantiateGuest(ctx, h.runtime, h.routes[route].compiled, h.moduleConfig(), nil)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to instantiate WASM module: %w", err)
+	}
+
+	return &cgiInstance{guestSlots: slots, handler: h}, nil
+}
+
+func (i *cgiInstance) NewHandler(_ context.Context, next Handler) Handler {
+	return HandlerFunc(func(rw http.ResponseWriter, req *http.Request) error {
+		return i.handler.serve(rw, req, next, i)
+	})
+}
+
+// parseRoute returns the route of a path, "/..." being the prefix route of
+// every path.
+func parseRoute(pattern string) (cgiRoute, error) {
+	if !strings.HasPrefix(pattern, "/") {
+		return cgiRoute{}, fmt.Errorf("the route %q does not start with /", pattern)
+	}
+
+	route := cgiRoute{pattern: pattern, path: pattern}
+	if pattern == wildcardSuffix || strings.HasSuffix(pattern, wildcardSuffix) {
+		route.path, route.prefix = strings.TrimSuffix(pattern, wildcardSuffix), true
+	}
+
+	route.path = path.Clean("/" + route.path)
+
+	return route, nil
+}
+
+// sortRoutes sorts the routes from the most specific one: the longest paths
+// first, an exact route before the prefix route of the same path.
+func sortRoutes(routes []cgiRoute) {
+	slices.SortStableFunc(routes, func(a, b cgiRoute) int {
+		if len(a.path) != len(b.path) {
+			return len(b.path) - len(a.path)
+		}
+
+		switch {
+		case a.prefix == b.prefix:
+			return 0
+		case a.prefix:
+			return 1
+		}
+
+		return -1
+	})
+}
+
+// newWasmHandlerCGI runs the module of the first route matching the request,
+// the source is the prefix route of every path when set. The routes without
+// match are passed to the next handler.
+func newWasmHandlerCGI(o BuilderOptions) (_ *WasmHandler, err error) {
+	ctx := context.Background()
+
+	runtime, err := newCGIRuntime(ctx, o)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err != nil {
+			_ = runtime.Close(ctx)
+		}
+	}()
+
+	routes := o.Routes
+	if o.Source != nil {
+		routes = append(slices.Clip(routes), Route{Path: wildcardSuffix, Source: o.Source})
+	}
+
+	if len(routes) == 0 {
+		return nil, fmt.Errorf("the cgi builder needs a module or a route")
+	}
+
+	wasmHandlerCGI := &cgiWASMHandler{
+		cgiRunner: newCGIRunner(runtime, o),
+		mounts:    o.Mounts,
+	}
+
+	for _, m := range o.Mounts {
+		if err = m.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Each slot holds an instance of every route module.
+	var reservation uint64
+
+	for _, r := range routes {
+		if r.Source == nil {
+			return nil, fmt.Errorf("the route %s has no module", r.Path)
+		}
+
+		route, err := parseRoute(r.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		if slices.ContainsFunc(wasmHandlerCGI.routes, func(c cgiRoute) bool {
+			return c.path == route.path && c.prefix == route.prefix
+		}) {
+			return nil, fmt.Errorf("the route %s is declared twice", r.Path)
+		}
+
+		code, err := r.Source.Bytes()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the CGI module %s: %w", r.Source.Name(), err)
+		}
+
+		route.compiled, err = runtime.CompileModule(ctx, code)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile the CGI module %s: %w", r.Source.Name(), err)
+		}
+
+		reservation += memoryReservation(o, route.compiled)
+		wasmHandlerCGI.routes = append(wasmHandlerCGI.routes, route)
+	}
+
+	sortRoutes(wasmHandlerCGI.routes)
+
+	w, err := newWasmHandler(withMemoryBudget(o.memoryBudget(), wasmHandlerCGI.newInstance, reservation), o.Pool, o.Logger)
+	if err != nil {
+		return nil, err
+	}
+
+	w.onClose(runtime.Close)
+
+	return w, nil
+}
@@ -0,0 +1,160 @@
+package wazemmes
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCGIBuilderTimeout(t *testing.T) {
+	guest := buildGuest(t, "cgi")
+
+	rec, err := serveGuest(t, "wagi", BuilderOptions{
+		Routes:  []Route{{Path: "/slow", Source: guest}, {Path: "/api/...", Source: guest}},
+		Timeout: 200 * time.Millisecond,
+	}, httptest.NewRequest(http.MethodGet, "/slow", nil))
+
+	if !errors.Is(err, ErrGuestTimeout) {
+		t.Errorf("got the error %v, expected %v", err, ErrGuestTimeout)
+	}
+
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Errorf("got the status %d, expected %d", rec.Code, http.StatusGatewayTimeout)
+	}
+}
+
+func TestParseRoute(t *testing.T) {
+	for _, tc := range []struct {
+		pattern string
+		path    string
+		prefix  bool
+		err     bool
+	}{
+		{pattern: "/", path: "/"},
+		{pattern: "/...", path: "/", prefix: true},
+		{pattern: "/api", path: "/api"},
+		{pattern: "/api/", path: "/api"},
+		{pattern: "/api/...", path: "/api", prefix: true},
+		{pattern: "/api/../admin/...", path: "/admin", prefix: true},
+		{pattern: "//api//v1", path: "/api/v1"},
+		{pattern: "/api...", path: "/api..."},
+		{pattern: "api", err: true},
+		{pattern: "", err: true},
+		{pattern: "...", err: true},
+	} {
+		t.Run(tc.pattern, func(t *testing.T) {
+			route, err := parseRoute(tc.pattern)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("got the route %+v, expected an error", route)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("got the error %v", err)
+			}
+
+			if route.pattern != tc.pattern || route.path != tc.path || route.prefix != tc.prefix {
+				t.Errorf("got the route %+v, expected the path %s (prefix %t)", route, tc.path, tc.prefix)
+			}
+		})
+	}
+}
+
+func TestRouteOrder(t *testing.T) {
+	h := &cgiWASMHandler{}
+
+	for _, pattern := range []string{"/...", "/api/...", "/api", "/api/v1/...", "/a", "/api/v1/users"} {
+		route, err := parseRoute(pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		h.routes = append(h.routes, route)
+	}
+
+	sortRoutes(h.routes)
+
+	patterns := make([]string, 0, len(h.routes))
+	for _, route := range h.routes {
+		patterns = append(patterns, route.pattern)
+	}
+
+	expected := []string{"/api/v1/users", "/api/v1/...", "/api", "/api/...", "/a", "/..."}
+	if !reflect.DeepEqual(patterns, expected) {
+		t.Fatalf("got the routes %v, expected %v", patterns, expected)
+	}
+
+	for _, tc := range []struct {
+		path     string
+		pattern  string
+		script   string
+		pathInfo string
+	}{
+		{path: "/api/v1/users", pattern: "/api/v1/users", script: "/api/v1/users"},
+		{path: "/api/v1/users/1", pattern: "/api/v1/...", script: "/api/v1", pathInfo: "/users/1"},
+		{path: "/api/v1", pattern: "/api/v1/...", script: "/api/v1"},
+		{path: "/api", pattern: "/api", script: "/api"},
+		{path: "/api/", pattern: "/api", script: "/api"},
+		{path: "/api/v2", pattern: "/api/...", script: "/api", pathInfo: "/v2"},
+		{path: "/apis", pattern: "/...", pathInfo: "/apis"},
+		{path: "/a", pattern: "/a", script: "/a"},
+		{path: "/a/b", pattern: "/...", pathInfo: "/a/b"},
+		{path: "/api/../a", pattern: "/a", script: "/a"},
+		{path: "/", pattern: "/...", script: "/"},
+	} {
+		t.Run(tc.path, func(t *testing.T) {
+			index, target, ok := h.route(tc.path)
+			if !ok {
+				t.Fatal("no route matches")
+			}
+
+			if h.routes[index].pattern != tc.pattern || target.name != tc.script || target.pathInfo != tc.pathInfo {
+				t.Errorf("got the route %s with the script %q and the path info %q, expected %s with %q and %q",
+					h.routes[index].pattern, target.name, target.pathInfo, tc.pattern, tc.script, tc.pathInfo)
+			}
+		})
+	}
+}
+
+func TestRouteWithoutMatch(t *testing.T) {
+	route, err := parseRoute("/api/...")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &cgiWASMHandler{routes: []cgiRoute{route}}
+
+	for _, urlPath := range []string{"/", "/apis", "/other/api"} {
+		if _, target, ok := h.route(urlPath); ok {
+			t.Errorf("the path %s matches with the script %q", urlPath, target.name)
+		}
+	}
+}
+
+func TestCGIArgs(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		target   script
+		rawQuery string
+		expected []string
+	}{
+		{name: "no query", target: script{name: "/api"}, expected: []string{"/api"}},
+		{name: "prefix root", target: script{pathInfo: "/a"}, expected: []string{"/"}},
+		{name: "parameters", target: script{name: "/api"}, rawQuery: "a=1&b", expected: []string{"/api", "a=1", "b"}},
+		{name: "decoded", target: script{name: "/api"}, rawQuery: "q=a+b%21", expected: []string{"/api", "q=a b!"}},
+		{name: "empty parameters", target: script{name: "/api"}, rawQuery: "&a&&", expected: []string{"/api", "a"}},
+		{name: "invalid escape", target: script{name: "/api"}, rawQuery: "q=%zz", expected: []string{"/api", "q=%zz"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if args := cgiArgs(tc.target, tc.rawQuery); !reflect.DeepEqual(args, tc.expected) {
+				t.Errorf("got the arguments %q, expected %q", args, tc.expected)
+			}
+		})
+	}
+}
@@ -32,6 +32,11 @@ func (w *writer) Write(b []byte) (int, error) {
 		return len(b), nil
 	}
 
+	// A streamed response goes to the client once flushed.
+	if w.written {
+		return w.res.Write(b)
+	}
+
 	w.buf.Reset()
 
 	return w.buf.Write(b)
@@ -43,6 +48,10 @@ func (w *writer) WriteHeader(status int) {
 
 func (w *writer) Flush() {
 	if w.written {
+		if flusher, ok := w.res.(http.Flusher); ok {
+			flusher.Flush()
+		}
+
 		return
 	}
 
@@ -50,3 +59,57 @@ func (w *writer) Flush() {
 	w.res.WriteHeader(w.status)
 	_, _ = w.res.Write(w.buf.Bytes())
 }
+
+// recorder buffers the downstream response to hand it to a guest.
+type recorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newRecorder() *recorder {
+	return &recorder{
+		header: make(http.Header),
+		status: http.StatusOK,
+	}
+}
+
+func (r *recorder) Header() http.Header {
+	return r.header
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	return r.body.Write(b)
+}
+
+func (r *recorder) WriteHeader(status int) {
+	r.status = status
+}
+
+// startedWriter records whether the response started, e.g. to not answer an
+// aborted guest once its streamed response was sent.
+type startedWriter struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (w *startedWriter) WriteHeader(status int) {
+	w.started = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *startedWriter) Write(b []byte) (int, error) {
+	w.started = true
+
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *startedWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *startedWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}